@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template/parse"
+
+	"bou.ke/statictemplate/internal"
+	"bou.ke/statictemplate/statictemplate"
+)
+
+const annotationPrefix = "statictemplate:"
+
+// discoverTargets finds the targets declared in the templates with comments like
+//
+//	{{/* statictemplate: func=Index dot=[]bou.ke/statictemplate/example.Post */}}
+//
+// The target uses the template the comment is in, so a comment inside a define
+// declares a target for that definition.
+func discoverTargets(root string, options statictemplate.ParseOptions, files []string) (compilationTargets, error) {
+	discovered, invalid, err := discoverAnnotations(root, options, files)
+	if err != nil {
+		return nil, err
+	}
+	if len(invalid) != 0 {
+		return nil, invalid[0]
+	}
+	return discovered, nil
+}
+
+// discoverAnnotations is like discoverTargets, but it skips invalid annotations
+// and returns them as invalid instead of stopping at the first one
+func discoverAnnotations(root string, options statictemplate.ParseOptions, files []string) (discovered compilationTargets, invalid []error, err error) {
+	for _, file := range files {
+		treeSet, err := parseTreeSet(root, options, file)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		names := make([]string, 0, len(treeSet))
+		for name := range treeSet {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			tree := treeSet[name]
+			walkComments(tree.Root, func(node *parse.CommentNode) {
+				target, ok, err := parseAnnotation(name, node.Text)
+				if err != nil {
+					name, line, column := internal.Position(tree, node)
+					invalid = append(invalid, &statictemplate.Error{Template: name, Line: line, Column: column, Err: err})
+				} else if ok {
+					discovered = append(discovered, target)
+				}
+			})
+		}
+	}
+	return discovered, invalid, nil
+}
+
+// parseTreeSet parses a template file the same way ParseFiles does, but
+// preserves comments and doesn't need the funcs. It returns the trees of the
+// templates in it by name, including the ones it defines.
+func parseTreeSet(root string, options statictemplate.ParseOptions, file string) (map[string]*parse.Tree, error) {
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	tree := parse.New(templateName(root, file))
+	tree.Mode = parse.ParseComments | parse.SkipFuncCheck
+	treeSet := make(map[string]*parse.Tree)
+	if _, err := tree.Parse(string(contents), options.LeftDelim, options.RightDelim, treeSet); err != nil {
+		return nil, err
+	}
+	return treeSet, nil
+}
+
+// definedTemplateNames returns the names of the template files, and of the
+// templates defined in them with {{define}}. Files that don't parse are skipped,
+// as discovering their annotations reports the error.
+func definedTemplateNames(root string, options statictemplate.ParseOptions, files []string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	for _, file := range files {
+		add(templateName(root, file))
+		treeSet, err := parseTreeSet(root, options, file)
+		if err != nil {
+			continue
+		}
+		for name := range treeSet {
+			add(name)
+		}
+	}
+	return names
+}
+
+func walkComments(node parse.Node, f func(*parse.CommentNode)) {
+	switch node := node.(type) {
+	case *parse.CommentNode:
+		f(node)
+	case *parse.ListNode:
+		if node == nil {
+			return
+		}
+		for _, item := range node.Nodes {
+			walkComments(item, f)
+		}
+	case *parse.IfNode:
+		walkComments(node.List, f)
+		walkComments(node.ElseList, f)
+	case *parse.RangeNode:
+		walkComments(node.List, f)
+		walkComments(node.ElseList, f)
+	case *parse.WithNode:
+		walkComments(node.List, f)
+		walkComments(node.ElseList, f)
+	}
+}
+
+// parseAnnotation parses the text of a comment. ok is false if it isn't an annotation
+func parseAnnotation(templateName, comment string) (target compilationTarget, ok bool, err error) {
+	text := strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(comment, "/*"), "*/"))
+	if !strings.HasPrefix(text, annotationPrefix) {
+		return compilationTarget{}, false, nil
+	}
+	text = strings.TrimSpace(strings.TrimPrefix(text, annotationPrefix))
+
+	values := make(map[string]string)
+	for text != "" {
+		i := strings.IndexByte(text, '=')
+		if i <= 0 {
+			return compilationTarget{}, false, fmt.Errorf("expect key=value in annotation, got %q", text)
+		}
+		key := text[:i]
+		text = text[i+1:]
+		var value string
+		if strings.HasPrefix(text, `"`) {
+			quoted, err := strconv.QuotedPrefix(text)
+			if err != nil {
+				return compilationTarget{}, false, fmt.Errorf("invalid quoted value for %s: %v", key, err)
+			}
+			value, _ = strconv.Unquote(quoted)
+			text = text[len(quoted):]
+		} else if i := strings.IndexAny(text, " \t\n"); i >= 0 {
+			value, text = text[:i], text[i:]
+		} else {
+			value, text = text, ""
+		}
+		values[key] = value
+		text = strings.TrimSpace(text)
+	}
+
+	for key := range values {
+		if key != "func" && key != "dot" {
+			return compilationTarget{}, false, fmt.Errorf("unknown key %s in annotation", key)
+		}
+	}
+	if values["func"] == "" || values["dot"] == "" {
+		return compilationTarget{}, false, fmt.Errorf("annotation needs both func and dot")
+	}
+	var targets compilationTargets
+	if err := targets.Set(fmt.Sprintf("%s:%s:%s", values["func"], templateName, values["dot"])); err != nil {
+		return compilationTarget{}, false, err
+	}
+	return targets[0], true, nil
+}
+
+// mergeTargets adds the explicit targets to the discovered ones, replacing discovered targets with the same function name
+func mergeTargets(discovered, explicit compilationTargets) compilationTargets {
+	overridden := make(map[string]bool)
+	for _, t := range explicit {
+		overridden[t.functionName] = true
+	}
+	var merged compilationTargets
+	for _, t := range discovered {
+		if !overridden[t.functionName] {
+			merged = append(merged, t)
+		}
+	}
+	return append(merged, explicit...)
+}
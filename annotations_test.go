@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"bou.ke/statictemplate/internal"
+	"bou.ke/statictemplate/statictemplate"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiscoverTargets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statictemplate")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	index := filepath.Join(dir, "index.tmpl")
+	assert.NoError(t, ioutil.WriteFile(index, []byte(`{{/* statictemplate: func=Index dot=[]bou.ke/statictemplate/example.Post */}}
+{{ range . }}{{ template "post" . }}{{ end }}
+{{ define "post" }}{{/* statictemplate: func=Post dot="bou.ke/statictemplate/example.Post" */}}{{ .Title }}{{ end }}
+{{/* just a comment */}}`), 0644))
+
+	discovered, err := discoverTargets("", statictemplate.ParseOptions{}, []string{index})
+	if assert.NoError(t, err) {
+		assert.Equal(t, compilationTargets{
+			{
+				functionName: "Index",
+				templateName: "index.tmpl",
+				dot: internal.TypeExpr{
+					Source:  "[]bou.ke/statictemplate/example.Post",
+					Imports: []string{"bou.ke/statictemplate/example"},
+				},
+			},
+			{
+				functionName: "Post",
+				templateName: "post",
+				dot: internal.TypeExpr{
+					Source:  "bou.ke/statictemplate/example.Post",
+					Imports: []string{"bou.ke/statictemplate/example"},
+				},
+			},
+		}, discovered)
+
+		var explicit compilationTargets
+		assert.NoError(t, explicit.Set("Index:index.tmpl:string"))
+		assert.Equal(t, compilationTargets{discovered[1], explicit[0]}, mergeTargets(discovered, explicit))
+	}
+}
+
+func TestDiscoverTargetsRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statictemplate")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "admin"), 0755))
+	index := filepath.Join(dir, "admin", "index.tmpl")
+	assert.NoError(t, ioutil.WriteFile(index, []byte(`{{/* statictemplate: func=AdminIndex dot=string */}}`), 0644))
+
+	discovered, err := discoverTargets(dir, statictemplate.ParseOptions{}, []string{index})
+	if assert.NoError(t, err) && assert.Len(t, discovered, 1) {
+		assert.Equal(t, "admin/index.tmpl", discovered[0].templateName)
+	}
+}
+
+func TestDiscoverTargetsDelims(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statictemplate")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	index := filepath.Join(dir, "index.tmpl")
+	assert.NoError(t, ioutil.WriteFile(index, []byte(`[[/* statictemplate: func=Index dot=string */]]{{ literal }}`), 0644))
+
+	discovered, err := discoverTargets("", statictemplate.ParseOptions{LeftDelim: "[[", RightDelim: "]]"}, []string{index})
+	if assert.NoError(t, err) && assert.Len(t, discovered, 1) {
+		assert.Equal(t, "Index", discovered[0].functionName)
+	}
+}
+
+func TestDiscoverTargetsError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statictemplate")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	index := filepath.Join(dir, "index.tmpl")
+	assert.NoError(t, ioutil.WriteFile(index, []byte("hello\n{{/* statictemplate: func=Index */}}"), 0644))
+
+	_, err = discoverTargets("", statictemplate.ParseOptions{}, []string{index})
+	assert.EqualError(t, err, "index.tmpl:2:3: annotation needs both func and dot")
+}
+
+func TestDefinedTemplateNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statictemplate")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	layout := filepath.Join(dir, "layout.tmpl")
+	broken := filepath.Join(dir, "broken.tmpl")
+	assert.NoError(t, ioutil.WriteFile(layout, []byte(`{{ define "partials/row" }}{{ . }}{{ end }}{{ template "partials/row" . }}`), 0644))
+	assert.NoError(t, ioutil.WriteFile(broken, []byte(`{{ define "partials/cell" }}`), 0644))
+
+	names := definedTemplateNames(dir, statictemplate.ParseOptions{}, []string{layout, broken})
+	sort.Strings(names)
+	assert.Equal(t, []string{"broken.tmpl", "layout.tmpl", "partials/row"}, names)
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template/parse"
+
+	"bou.ke/statictemplate/statictemplate"
+	"golang.org/x/tools/go/packages"
+)
+
+// config is the format of the file passed in with -config
+type config struct {
+	// Tags and Mod are passed on to the go command when loading packages
+	Tags   string         `json:"tags"`
+	Mod    string         `json:"mod"`
+	Groups []*outputGroup `json:"groups"`
+}
+
+// outputGroup describes a set of templates and the targets generated from them into a single output file
+type outputGroup struct {
+	Templates []string `json:"templates"`
+	Root      string   `json:"root"`
+	HTML      bool     `json:"html"`
+	Delims    string   `json:"delims"`
+	// MissingKey and ParseMode are the values of -missingkey and -parsemode
+	MissingKey string `json:"missingkey"`
+	ParseMode  string `json:"parsemode"`
+	Funcs      string `json:"funcs"`
+	Package    string `json:"package"`
+	Output     string `json:"output"`
+	Dev        string `json:"dev"`
+	DevCheck   bool   `json:"devcheck"`
+	Context    bool   `json:"context"`
+	Registry   string `json:"registry"`
+	Fallback   bool   `json:"fallback"`
+	Variants   string `json:"variants"`
+	Sizes      bool   `json:"sizes"`
+	// AverageSizes is the value of -averagesizes
+	AverageSizes string `json:"averagesizes"`
+	StaticBytes  bool   `json:"staticbytes"`
+	Inline       int    `json:"inline"`
+	Handlers     bool   `json:"handlers"`
+	Buffered     bool   `json:"buffered"`
+	// Implementations maps interface types to the concrete types their values can have
+	Implementations implementations    `json:"implementations"`
+	Stubs           string             `json:"stubs"`
+	Source          string             `json:"source"`
+	Rewrite         bool               `json:"rewrite"`
+	Targets         compilationTargets `json:"targets"`
+
+	templateFiles []string
+	// templateTargets are the targets declared in the templates
+	templateTargets compilationTargets
+	stubTargets     compilationTargets
+	stubFiles       []string
+	sourcePackage   *packages.Package
+	sources         []sourceTemplate
+	sourceTargets   compilationTargets
+	// targets are the explicit targets merged with the ones declared in templates, stubs and source
+	targets compilationTargets
+	// discoveryErrors are the invalid annotations found when vetting
+	discoveryErrors []error
+	// packagePath is the import path of the generated package, if known
+	packagePath string
+	// contextSet is whether Context was set explicitly
+	contextSet bool
+	// minSizes are the minimum output sizes of the targets, if Sizes is set
+	minSizes []int
+	// buildFlags are the flags the packages are loaded with
+	buildFlags []string
+}
+
+func (c *compilationTarget) UnmarshalJSON(data []byte) error {
+	var target struct {
+		Func     string `json:"func"`
+		Template string `json:"template"`
+		Dot      string `json:"dot"`
+	}
+	if err := json.Unmarshal(data, &target); err != nil {
+		return err
+	}
+	if target.Func == "" || target.Template == "" || target.Dot == "" {
+		return fmt.Errorf("expect compilation target with func, template and dot, got %s", data)
+	}
+	var targets compilationTargets
+	if err := targets.Set(fmt.Sprintf("%s:%s:%s", target.Func, target.Template, target.Dot)); err != nil {
+		return err
+	}
+	*c = targets[0]
+	return nil
+}
+
+// loadConfig reads a config file. Relative paths in the file are relative to the directory of the file
+func loadConfig(name string) (*config, error) {
+	contents, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var c config
+	if err := json.Unmarshal(contents, &c); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	if len(c.Groups) == 0 {
+		return nil, fmt.Errorf("%s: no groups defined", name)
+	}
+
+	dir := filepath.Dir(name)
+	rel := func(path string) string {
+		if path == "" || filepath.IsAbs(path) {
+			return path
+		}
+		return filepath.Join(dir, path)
+	}
+	for _, g := range c.Groups {
+		if g.Root != "" {
+			// Templates are relative to the root
+			g.Root = rel(g.Root)
+		} else {
+			for j := range g.Templates {
+				g.Templates[j] = rel(g.Templates[j])
+			}
+		}
+		if g.Output == "" {
+			g.Output = "template.go"
+		}
+		g.Output = rel(g.Output)
+		g.Dev = rel(g.Dev)
+		// Keep the stubs and source packages relative paths for go/packages
+		if strings.HasPrefix(g.Stubs, ".") {
+			if g.Stubs = rel(g.Stubs); !filepath.IsAbs(g.Stubs) {
+				g.Stubs = "./" + g.Stubs
+			}
+		}
+		if strings.HasPrefix(g.Source, ".") {
+			if g.Source = rel(g.Source); !filepath.IsAbs(g.Source) {
+				g.Source = "./" + g.Source
+			}
+		}
+		g.contextSet = g.Context
+	}
+	return &c, nil
+}
+
+// applyFlags overrides the config with the flags that were passed in explicitly
+func (c *config) applyFlags() error {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	for _, name := range []string{"o", "dev", "t"} {
+		if set[name] && len(c.Groups) != 1 {
+			return fmt.Errorf("-%s can only be used with a config file that has a single group", name)
+		}
+	}
+	if flag.NArg() > 0 && len(c.Groups) != 1 {
+		return fmt.Errorf("template globs can only be passed in with a config file that has a single group")
+	}
+
+	if set["tags"] {
+		c.Tags = buildTags
+	}
+	if set["mod"] {
+		c.Mod = modFlag
+	}
+	for _, g := range c.Groups {
+		if flag.NArg() > 0 {
+			g.Templates = flag.Args()
+		}
+		if set["t"] {
+			g.Targets = targets
+		}
+		if set["root"] {
+			g.Root = templateRoot
+		}
+		if set["html"] {
+			g.HTML = html
+		}
+		if set["delims"] {
+			g.Delims = delims
+		}
+		if set["missingkey"] {
+			g.MissingKey = missingKey
+		}
+		if set["parsemode"] {
+			g.ParseMode = parseMode
+		}
+		if set["funcs"] {
+			g.Funcs = funcMap
+		}
+		if set["package"] {
+			g.Package = packageName
+		}
+		if set["o"] {
+			g.Output = outputFile
+		}
+		if set["dev"] {
+			g.Dev = devOutputFile
+		}
+		if set["devcheck"] {
+			g.DevCheck = devCheck
+		}
+		if set["context"] {
+			g.Context = withContext
+			g.contextSet = true
+		}
+		if set["registry"] {
+			g.Registry = registry
+		}
+		if set["fallback"] {
+			g.Fallback = fallback
+		}
+		if set["variants"] {
+			g.Variants = variants
+		}
+		if set["sizes"] {
+			g.Sizes = sizes
+		}
+		if set["averagesizes"] {
+			g.AverageSizes = averageSizes
+		}
+		if set["staticbytes"] {
+			g.StaticBytes = staticBytes
+		}
+		if set["inline"] {
+			g.Inline = inline
+		}
+		if set["handlers"] {
+			g.Handlers = handlers
+		}
+		if set["buffered"] {
+			g.Buffered = buffered
+		}
+		if set["impl"] {
+			g.Implementations = impls
+		}
+		if set["stubs"] {
+			g.Stubs = stubs
+		}
+		if set["source"] {
+			g.Source = sourcePackage
+		}
+		if set["rewrite"] {
+			g.Rewrite = rewrite
+		}
+	}
+	return nil
+}
+
+// flagConfig creates a config from the flags when no config file is used
+func flagConfig() *config {
+	return &config{
+		Tags: buildTags,
+		Mod:  modFlag,
+		Groups: []*outputGroup{{
+			Templates:       flag.Args(),
+			Root:            templateRoot,
+			HTML:            html,
+			Delims:          delims,
+			MissingKey:      missingKey,
+			ParseMode:       parseMode,
+			Funcs:           funcMap,
+			Package:         packageName,
+			Output:          outputFile,
+			Dev:             devOutputFile,
+			DevCheck:        devCheck,
+			Context:         withContext,
+			Registry:        registry,
+			Fallback:        fallback,
+			Variants:        variants,
+			Sizes:           sizes,
+			AverageSizes:    averageSizes,
+			StaticBytes:     staticBytes,
+			Inline:          inline,
+			Handlers:        handlers,
+			Buffered:        buffered,
+			Implementations: impls,
+			Stubs:           stubs,
+			Source:          sourcePackage,
+			Rewrite:         rewrite,
+			Targets:         targets,
+
+			contextSet: contextFlagSet(),
+		}},
+	}
+}
+
+// parseOptions returns the options the templates of the group are parsed with
+func (g *outputGroup) parseOptions() (statictemplate.ParseOptions, error) {
+	var options statictemplate.ParseOptions
+	if g.Delims != "" {
+		delims := strings.Fields(g.Delims)
+		if len(delims) != 2 {
+			return options, fmt.Errorf("expect delims in \"<left> <right>\" format, got %q", g.Delims)
+		}
+		options.LeftDelim, options.RightDelim = delims[0], delims[1]
+	}
+	for _, mode := range strings.Split(g.ParseMode, ",") {
+		switch strings.TrimSpace(mode) {
+		case "":
+		case "comments":
+			options.Mode |= parse.ParseComments
+		case "skipfunccheck":
+			options.Mode |= parse.SkipFuncCheck
+		default:
+			return options, fmt.Errorf("unknown parse mode %q, expected comments or skipfunccheck", mode)
+		}
+	}
+	return options, nil
+}
+
+// variants returns whether the String and Append companions are generated
+func (g *outputGroup) variants() (withString, withAppend bool, err error) {
+	for _, variant := range strings.Split(g.Variants, ",") {
+		switch strings.TrimSpace(variant) {
+		case "":
+		case "string":
+			withString = true
+		case "append":
+			withAppend = true
+		default:
+			return false, false, fmt.Errorf("unknown variant %q, expected string or append", variant)
+		}
+	}
+	return
+}
+
+// averageSizes returns the average output sizes of the functions, by function name
+func (g *outputGroup) averageSizes() (map[string]int, error) {
+	if g.AverageSizes == "" {
+		return nil, nil
+	}
+	sizes := make(map[string]int)
+	for _, pair := range strings.Split(g.AverageSizes, ",") {
+		values := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(values) != 2 || values[0] == "" {
+			return nil, fmt.Errorf("expect average size in <function>=<bytes> format, got %q", pair)
+		}
+		size, err := strconv.Atoi(values[1])
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("expect average size in <function>=<bytes> format, got %q", pair)
+		}
+		sizes[values[0]] = size
+	}
+	return sizes, nil
+}
+
+func contextFlagSet() (set bool) {
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "context" {
+			set = true
+		}
+	})
+	return
+}
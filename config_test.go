@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"bou.ke/statictemplate/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statictemplate")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "statictemplate.json")
+	assert.NoError(t, ioutil.WriteFile(name, []byte(`{
+  "tags": "integration",
+  "groups": [
+    {
+      "templates": ["template/*.tmpl"],
+      "html": true,
+      "targets": [
+        {"func": "Index", "template": "index.tmpl", "dot": "[]bou.ke/statictemplate/example.Post"}
+      ]
+    },
+    {
+      "templates": ["*.tmpl", "admin/*.tmpl"],
+      "root": "email",
+      "output": "email/email.go",
+      "dev": "email/email_dev.go",
+      "targets": [
+        {"func": "Welcome", "template": "welcome.tmpl", "dot": "string"}
+      ]
+    }
+  ]
+}`), 0644))
+
+	c, err := loadConfig(name)
+	if assert.NoError(t, err) {
+		assert.Equal(t, &config{
+			Tags: "integration",
+			Groups: []*outputGroup{
+				{
+					Templates: []string{filepath.Join(dir, "template/*.tmpl")},
+					HTML:      true,
+					Output:    filepath.Join(dir, "template.go"),
+					Targets: compilationTargets{{
+						functionName: "Index",
+						templateName: "index.tmpl",
+						dot: internal.TypeExpr{
+							Source:  "[]bou.ke/statictemplate/example.Post",
+							Imports: []string{"bou.ke/statictemplate/example"},
+						},
+					}},
+				},
+				{
+					Templates: []string{"*.tmpl", "admin/*.tmpl"},
+					Root:      filepath.Join(dir, "email"),
+					Output:    filepath.Join(dir, "email/email.go"),
+					Dev:       filepath.Join(dir, "email/email_dev.go"),
+					Targets: compilationTargets{{
+						functionName: "Welcome",
+						templateName: "welcome.tmpl",
+						dot:          internal.TypeExpr{Source: "string"},
+					}},
+				},
+			},
+		}, c)
+	}
+}
+
+func TestLoadConfigError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statictemplate")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "statictemplate.json")
+	assert.NoError(t, ioutil.WriteFile(name, []byte(`{"groups": [{"targets": [{"func": "Index"}]}]}`), 0644))
+	_, err = loadConfig(name)
+	assert.EqualError(t, err, name+`: expect compilation target with func, template and dot, got {"func": "Index"}`)
+}
+
+func TestAverageSizes(t *testing.T) {
+	sizes, err := (&outputGroup{AverageSizes: "Index=48213, Post=1024"}).averageSizes()
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]int{"Index": 48213, "Post": 1024}, sizes)
+	}
+	_, err = (&outputGroup{AverageSizes: "Index"}).averageSizes()
+	assert.EqualError(t, err, `expect average size in <function>=<bytes> format, got "Index"`)
+	_, err = (&outputGroup{AverageSizes: "Index=-1"}).averageSizes()
+	assert.Error(t, err)
+}
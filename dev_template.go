@@ -2,56 +2,487 @@ package main
 
 import (
 	"fmt"
+	"go/types"
 	"io"
+	"sort"
+	"strings"
+	"text/template/parse"
+
+	"bou.ke/statictemplate/internal"
+	"bou.ke/statictemplate/statictemplate"
 )
 
-func writeDevTemplate(w io.Writer, targets compilationTargets, templateFiles []string, html bool, funcMapImport, funcMapName string, pkg string) error {
-	fmt.Fprintf(w, `// +build dev
+// writeDevTemplate writes the dev output of the group, with ins the instructions
+// the generated code is translated from
+func writeDevTemplate(w io.Writer, g *outputGroup, ins []statictemplate.TranslateInstruction, funcs map[string]*types.Func, funcMapImport, funcMapName string, pkg string) error {
+	// Templates from Go source are executed with the variable they're assigned to
+	sourceVariables := make(map[string]string)
+	for _, source := range g.sources {
+		if source.variable != nil {
+			sourceVariables[source.name] = source.variable.Name()
+		} else {
+			sourceVariables[source.name] = ""
+		}
+	}
+	for _, file := range g.templateFiles {
+		delete(sourceVariables, templateName(g.Root, file))
+	}
+	var fileTargets compilationTargets
+	for _, target := range g.targets {
+		if variable, ok := sourceVariables[target.templateName]; !ok {
+			fileTargets = append(fileTargets, target)
+		} else if variable == "" {
+			return fmt.Errorf("template %s must be assigned to a package-level variable to be executed by the dev output", target.templateName)
+		}
+	}
+	withFiles := len(g.templateFiles) != 0
+
+	options, err := g.parseOptions()
+	if err != nil {
+		return err
+	}
+
+	withContext := g.Context
+	var contextFuncs []string
+	if withContext && len(fileTargets) != 0 {
+		for name, f := range funcs {
+			if internal.TakesContext(f.Type().(*types.Signature)) {
+				contextFuncs = append(contextFuncs, name)
+			}
+		}
+		sort.Strings(contextFuncs)
+	}
+
+	var imports []string
+	aliases := make(map[string]string)
+	alias := func(path string) string {
+		if path == g.packagePath {
+			return ""
+		}
+		if _, ok := aliases[path]; !ok {
+			aliases[path] = fmt.Sprintf("pkg%d", len(aliases))
+			imports = append(imports, path)
+		}
+		return aliases[path]
+	}
+	dots := make([]string, len(g.targets))
+	for i, target := range g.targets {
+		if target.typ != nil {
+			dots[i] = types.TypeString(target.typ, func(pkg *types.Package) string {
+				return alias(pkg.Path())
+			})
+		} else {
+			dots[i] = target.dot.Format(alias)
+		}
+	}
+	funcMap := funcMapName
+	if funcMapImport != "" && funcMapImport != g.packagePath {
+		funcMap = "funcMapImport." + funcMapName
+	}
+
+	constraint := "dev"
+	if g.Stubs != "" {
+		constraint += ",!" + stubBuildTag
+	}
+	fmt.Fprintf(w, `// +build %s
 
 package %s
 
 import (
   "io"
-`, pkg)
-	if html {
+`, constraint, pkg)
+	if withFiles {
+		io.WriteString(w, "\"sync\"\n\"bou.ke/statictemplate/statictemplate\"\n")
+		if options.Mode != 0 {
+			io.WriteString(w, "\"text/template/parse\"\n")
+		}
+		if g.Root != "" {
+			io.WriteString(w, "\"io/fs\"\n")
+		}
+		io.WriteString(w, "\"os\"\n\"time\"\n")
+	}
+	if withFiles && g.HTML {
 		io.WriteString(w, `"html/template"
   `)
-	} else {
+	} else if withFiles {
 		io.WriteString(w, `"text/template"
   `)
 	}
-	if funcMapImport != "" {
-		fmt.Fprintf(w, "funcMapImport %q\n", funcMapImport)
+	if withContext {
+		io.WriteString(w, "\"context\"\n")
 	}
-	for i, target := range targets {
-		if target.dot.packagePath != "" {
-			fmt.Fprintf(w, "pkg%d %q\n", i, target.dot.packagePath)
+	if g.Registry != "" {
+		io.WriteString(w, "\"fmt\"\n")
+	}
+	withString, withAppend, err := g.variants()
+	if err != nil {
+		return err
+	}
+	averageSizes, err := g.averageSizes()
+	if err != nil {
+		return err
+	}
+	if withString {
+		io.WriteString(w, "\"strings\"\n")
+	}
+	if withAppend || g.Handlers || g.Buffered {
+		io.WriteString(w, "\"bytes\"\n")
+	}
+	if g.Handlers {
+		io.WriteString(w, "\"errors\"\n\"hash/fnv\"\n\"net/http\"\n\"strconv\"\n")
+		// The loader of template files imports time already
+		if !withFiles {
+			io.WriteString(w, "\"time\"\n")
 		}
 	}
+	if len(contextFuncs) != 0 {
+		io.WriteString(w, "\"reflect\"\n")
+	}
+	if withFiles && funcMapImport != "" && funcMapImport != g.packagePath {
+		fmt.Fprintf(w, "funcMapImport %q\n", funcMapImport)
+	}
+	for _, path := range imports {
+		fmt.Fprintf(w, "%s %q\n", aliases[path], path)
+	}
 	io.WriteString(w, ")\n")
-	for i, target := range targets {
-		var dot string
-		if target.dot.packagePath == "" {
-			dot = fmt.Sprintf("%s%s", target.dot.prefix, target.dot.typeName)
-		} else {
-			dot = fmt.Sprintf("%spkg%d.%s", target.dot.prefix, i, target.dot.typeName)
+
+	io.WriteString(w, "\n")
+	if withFiles {
+		if g.Root != "" {
+			// The templates are named by their path in the root, like in the generated code
+			fmt.Fprintf(w, `// devTemplateFS is the root the names of devTemplateFiles are relative to
+var devTemplateFS = os.DirFS(%q)
+
+`, g.Root)
+		}
+		io.WriteString(w, `var devTemplateFiles = []string{
+`)
+		for _, templateFile := range g.templateFiles {
+			if g.Root != "" {
+				templateFile = templateName(g.Root, templateFile)
+			}
+			fmt.Fprintf(w, "%q,\n", templateFile)
 		}
-		fmt.Fprintf(w, `func %s(w io.Writer, dot %s) error {
-  temp, err := template.New("")`, target.functionName, dot)
+		io.WriteString(w, "}\n")
+		if g.DevCheck {
+			writeDevChecker(w, g, fileTargets, withContext)
+		}
+
+		// The templates are parsed with the same options as the generated code, and
+		// missing map keys give the zero value like in the generated code by default
+		missingKey := g.MissingKey
+		if missingKey == "" {
+			missingKey = "zero"
+		}
+		newTemplate := fmt.Sprintf("template.New(\"\").Option(%q)", "missingkey="+missingKey)
 		if funcMapName != "" {
-			fmt.Fprintf(w, ".Funcs(funcMapImport.%s)", funcMapName)
+			newTemplate += fmt.Sprintf(".Funcs(%s)", funcMap)
 		}
-		io.WriteString(w, ".ParseFiles(\n")
-		for _, templateFile := range templateFiles {
-			fmt.Fprintf(w, "%q,\n", templateFile)
+		io.WriteString(w, "\nvar devParseOptions = statictemplate.ParseOptions{")
+		if options.LeftDelim != "" {
+			fmt.Fprintf(w, "LeftDelim: %q, RightDelim: %q,", options.LeftDelim, options.RightDelim)
+		}
+		if options.Mode != 0 {
+			var modes []string
+			if options.Mode&parse.ParseComments != 0 {
+				modes = append(modes, "parse.ParseComments")
+			}
+			if options.Mode&parse.SkipFuncCheck != 0 {
+				modes = append(modes, "parse.SkipFuncCheck")
+			}
+			fmt.Fprintf(w, "Mode: %s,", strings.Join(modes, " | "))
+		}
+		io.WriteString(w, "}\n")
+		writeDevFileLoader(w, g.Root != "", newTemplate, g.DevCheck)
+	}
+
+	// With Buffered, the templates are executed into a buffer like the generated code
+	execute := func(temp string) string {
+		return temp + ".ExecuteTemplate"
+	}
+	if g.Buffered {
+		execute = func(temp string) string {
+			return "executeBuffered(" + temp + ")"
+		}
+	}
+	for i, target := range g.targets {
+		dot := dots[i]
+		var ctx string
+		if withContext {
+			ctx = "ctx context.Context, "
 		}
-		io.WriteString(w, `)
-        if err != nil {
-          return err
-        }
-        return temp.Execute(w, dot)
+		if variable, ok := sourceVariables[target.templateName]; ok {
+			fmt.Fprintf(w, `
+func %s(%sw io.Writer, dot %s) error {
+  return %s(w, %q, dot)
 }
+`, target.functionName, ctx, dot, execute(variable), target.templateName)
+			continue
+		}
+		fmt.Fprintf(w, `
+func %s(%sw io.Writer, dot %s) error {
+  temp, err := loadDevTemplate()
+  if err != nil {
+    return err
+  }
+`, target.functionName, ctx, dot)
+		if len(contextFuncs) != 0 {
+			// The cached templates are never executed, so they can be cloned to bind ctx
+			io.WriteString(w, `temp, err = temp.Clone()
+  if err != nil {
+    return err
+  }
+  temp.Funcs(template.FuncMap{
 `)
+			for _, name := range contextFuncs {
+				fmt.Fprintf(w, "%q: bindContext(ctx, %s[%q]),\n", name, funcMap, name)
+			}
+			io.WriteString(w, "})\n")
+		}
+		fmt.Fprintf(w, `  return %s(w, %q, dot)
+}
+`, execute("temp"), target.templateName)
+	}
+	if g.Buffered {
+		io.WriteString(w, `
+// executeBuffered returns a function that executes a template of temp into a
+// buffer, and only writes it to w when it succeeds
+func executeBuffered(temp interface {
+  ExecuteTemplate(io.Writer, string, interface{}) error
+}) func(io.Writer, string, interface{}) error {
+  return func(w io.Writer, name string, dot interface{}) error {
+    var buf bytes.Buffer
+    if err := temp.ExecuteTemplate(&buf, name, dot); err != nil {
+      return err
+    }
+    _, err := w.Write(buf.Bytes())
+    return err
+  }
+}
+`)
+	}
+	if len(contextFuncs) != 0 {
+		io.WriteString(w, `
+// bindContext returns a function that calls fn with ctx as its first argument
+func bindContext(ctx context.Context, fn interface{}) func(...interface{}) (interface{}, error) {
+  return func(args ...interface{}) (interface{}, error) {
+    f := reflect.ValueOf(fn)
+    in := []reflect.Value{reflect.ValueOf(ctx)}
+    for i, arg := range args {
+      typ := f.Type().In(len(in))
+      if f.Type().IsVariadic() && len(in) >= f.Type().NumIn()-1 {
+        typ = f.Type().In(f.Type().NumIn() - 1).Elem()
+      }
+      if arg == nil {
+        in = append(in, reflect.Zero(typ))
+      } else {
+        in = append(in, reflect.ValueOf(args[i]).Convert(typ))
+      }
+    }
+    out := f.Call(in)
+    if len(out) == 2 && !out[1].IsNil() {
+      return nil, out[1].Interface().(error)
+    }
+    return out[0].Interface(), nil
+  }
+}
+`)
+	}
+	sizes := make([]string, len(g.targets))
+	for i, target := range g.targets {
+		var ctxParam, ctxArg string
+		if withContext {
+			ctxParam, ctxArg = "ctx context.Context, ", "ctx, "
+		}
+		// The same constants as the generated file, growing the buffer by the larger one
+		var grow string
+		if g.minSizes != nil {
+			fmt.Fprintf(w, "\nconst %sMinSize = %d\n", target.functionName, g.minSizes[i])
+			size := target.functionName + "MinSize"
+			if averageSize, ok := averageSizes[target.functionName]; ok {
+				fmt.Fprintf(w, "\nconst %sAverageSize = %d\n", target.functionName, averageSize)
+				if averageSize > g.minSizes[i] {
+					size = target.functionName + "AverageSize"
+				}
+			}
+			grow = fmt.Sprintf("b.Grow(%s)\n", size)
+			sizes[i] = size
+		}
+		if withString {
+			fmt.Fprintf(w, `
+func %sString(%sdot %s) (string, error) {
+  var b strings.Builder
+  %serr := %s(%s&b, dot)
+  return b.String(), err
+}
+`, target.functionName, ctxParam, dots[i], grow, target.functionName, ctxArg)
+		}
+		if withAppend {
+			fmt.Fprintf(w, `
+func %sAppend(%sdst []byte, dot %s) ([]byte, error) {
+  b := bytes.NewBuffer(dst)
+  %serr := %s(%sb, dot)
+  return b.Bytes(), err
+}
+`, target.functionName, ctxParam, dots[i], grow, target.functionName, ctxArg)
+		}
+	}
+	if g.Handlers {
+		entries := make([]internal.HandlerEntry, len(g.targets))
+		for i, target := range g.targets {
+			entries[i] = internal.HandlerEntry{
+				FunctionName: target.functionName,
+				Dot:          dots[i],
+				Size:         sizes[i],
+			}
+		}
+		internal.WriteHandlers(w, internal.ContentType(g.HTML), withContext, entries)
+	}
+	if g.Registry != "" {
+		// The types are named by package name in errors, like in the static registry
+		entries := make([]internal.RegistryEntry, len(g.targets))
+		for i, target := range g.targets {
+			entries[i] = internal.RegistryEntry{
+				TemplateName: target.templateName,
+				FunctionName: target.functionName,
+				Dot:          dots[i],
+				Type:         types.TypeString(ins[i].Dot, (*types.Package).Name),
+			}
+		}
+		internal.WriteRegistry(w, g.Registry, withContext, entries)
 	}
+	writeStubAssignments(w, g.targets)
 	return nil
 }
+
+// writeDevFileLoader writes loadDevTemplate for templates that are read from the
+// working directory, and parsed again when they change. With rooted, they're
+// read from devTemplateFS and named by their path in it.
+func writeDevFileLoader(w io.Writer, rooted bool, newTemplate string, check bool) {
+	stat, parse := "os.Stat(file)", "ParseFiles(temp, devTemplateFiles...)"
+	if rooted {
+		stat, parse = "fs.Stat(devTemplateFS, file)", "ParseFS(temp, devTemplateFS, devTemplateFiles...)"
+	}
+	io.WriteString(w, `
+var (
+  devTemplateMu sync.Mutex
+  devTemplate *template.Template
+  devTemplateModTimes []time.Time
+)
+
+func init() {
+  if _, err := loadDevTemplate(); err != nil {
+    panic(err)
+  }
+}
+
+// loadDevTemplate returns the parsed templates, parsing them again if one of the files changed
+func loadDevTemplate() (*template.Template, error) {
+  modTimes := make([]time.Time, len(devTemplateFiles))
+  for i, file := range devTemplateFiles {
+    info, err := `+stat+`
+    if err != nil {
+      return nil, err
+    }
+    modTimes[i] = info.ModTime()
+  }
+
+  devTemplateMu.Lock()
+  defer devTemplateMu.Unlock()
+  changed := devTemplate == nil
+  for i, modTime := range modTimes {
+    changed = changed || !modTime.Equal(devTemplateModTimes[i])
+  }
+  if !changed {
+    return devTemplate, nil
+  }
+  temp := `+newTemplate+`
+  if err := devParseOptions.`+parse+`; err != nil {
+    return nil, err
+  }
+`+devCheckCall(check)+`  devTemplate, devTemplateModTimes = temp, modTimes
+  return temp, nil
+}
+`)
+	if check {
+		writeDevCheck(w)
+	}
+}
+
+// writeDevChecker writes devTemplateChecker, which type checks the templates
+// against the targets when they're parsed
+func writeDevChecker(w io.Writer, g *outputGroup, fileTargets compilationTargets, withContext bool) {
+	io.WriteString(w, `
+// devTemplateChecker reports the type errors the generated code would have
+var devTemplateChecker = &statictemplate.Checker{
+  Targets: []statictemplate.Target{
+`)
+	for _, target := range fileTargets {
+
+		// The types of stubs can be unexported, so they can't be loaded by name.
+		// They're checked when the code is generated instead.
+		if target.typ != nil {
+			continue
+		}
+		fmt.Fprintf(w, "{FunctionName: %q, TemplateName: %q, Dot: %q},\n", target.functionName, target.templateName, target.dot.Source)
+	}
+	io.WriteString(w, "},\n")
+	if len(g.buildFlags) != 0 {
+		io.WriteString(w, "BuildFlags: []string{")
+		for _, flag := range g.buildFlags {
+			fmt.Fprintf(w, "%q, ", flag)
+		}
+		io.WriteString(w, "},\n")
+	}
+	if g.Funcs != "" {
+		fmt.Fprintf(w, "Funcs: %q,\n", g.Funcs)
+	}
+	if withContext {
+		io.WriteString(w, "Context: true,\n")
+	}
+	if g.packagePath != "" {
+		fmt.Fprintf(w, "PackagePath: %q,\n", g.packagePath)
+	}
+	if len(g.Implementations) != 0 {
+		io.WriteString(w, "Implementations: map[string][]string{\n")
+		var ifaces []string
+		for iface := range g.Implementations {
+			ifaces = append(ifaces, iface)
+		}
+		sort.Strings(ifaces)
+		for _, iface := range ifaces {
+			fmt.Fprintf(w, "%q: {", iface)
+			for _, implementation := range g.Implementations[iface] {
+				fmt.Fprintf(w, "%q, ", implementation)
+			}
+			io.WriteString(w, "},\n")
+		}
+		io.WriteString(w, "},\n")
+	}
+	io.WriteString(w, "}\n")
+}
+
+// devCheckCall returns the call to checkDevTemplate after parsing, if the templates are type checked
+func devCheckCall(check bool) string {
+	if !check {
+		return ""
+	}
+	return `  if err := checkDevTemplate(temp); err != nil {
+    return nil, err
+  }
+`
+}
+
+func writeDevCheck(w io.Writer) {
+	io.WriteString(w, `
+// checkDevTemplate reports the type errors the generated code would have.
+// It checks a clone, as checking escapes html templates, after which they can't be cloned.
+func checkDevTemplate(temp *template.Template) error {
+  clone, err := temp.Clone()
+  if err != nil {
+    return err
+  }
+  return devTemplateChecker.Check(clone)
+}
+`)
+}
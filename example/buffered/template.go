@@ -0,0 +1,115 @@
+package buffered
+
+import (
+	pkg1 "bou.ke/statictemplate/example"
+	"bou.ke/statictemplate/funcs"
+	"bytes"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+func Index(w io.Writer, dot []pkg1.Post) error {
+	buf, err := fun6(dot)
+	if err != nil {
+		return err
+	}
+	defer fun5.put(buf)
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// fun6 renders Index into a buffer from fun5, which the caller puts back
+func fun6(dot []pkg1.Post) (buf *bytes.Buffer, err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			var ok bool
+			if err, ok = recovered.(error); !ok {
+				panic(recovered)
+			}
+		}
+	}()
+	buf = fun5.get()
+	if err = fun0(buf, dot); err != nil {
+		fun5.put(buf)
+		return nil, err
+	}
+	fun5.observe(buf.Len())
+	return buf, nil
+}
+
+// header.tmpl(string)
+func fun2(w io.Writer, dot string) error {
+	_, _ = io.WriteString(w, "<!doctype html>\n<html>\n  <head>\n    ")
+	if eval := dot; len(eval) != 0 {
+		_, _ = io.WriteString(w, "\n    <title>Bouke's Blog | ")
+		_, _ = io.WriteString(w, funcs.Rcdataescaper(dot))
+		_, _ = io.WriteString(w, "</title>\n    ")
+	} else {
+		_, _ = io.WriteString(w, "\n    <title>Bouke's Blog</title>\n    ")
+	}
+	_, _ = io.WriteString(w, "\n  </head>\n  <body>\n")
+	return nil
+}
+
+// post.tmpl(pkg1.Post)
+func fun3(w io.Writer, dot pkg1.Post) error {
+	_, _ = io.WriteString(w, "<article>\n  <h2>")
+	_, _ = io.WriteString(w, funcs.Htmlescaper(dot.Title))
+	_, _ = io.WriteString(w, "</h2>\n  <p>")
+	_, _ = io.WriteString(w, funcs.Htmlescaper(dot.Body))
+	_, _ = io.WriteString(w, "</h2>\n</article>\n")
+	return nil
+}
+
+// index.tmpl([]pkg1.Post)
+func fun0(w io.Writer, dot []pkg1.Post) error {
+	if err := fun2(w, "Index"); err != nil {
+		return err
+	}
+	_, _ = io.WriteString(w, "\n\n<section>\n")
+	if eval := dot; len(eval) != 0 {
+		for _, _Varpost := range eval {
+			dot := _Varpost
+			_ = dot
+			_, _ = io.WriteString(w, "\n")
+			if err := fun3(w, _Varpost); err != nil {
+				return err
+			}
+			_, _ = io.WriteString(w, "\n")
+		}
+	}
+	_, _ = io.WriteString(w, "\n</section>\n\n</body>\n</html>\n\n")
+	return nil
+}
+
+// fun4 is a pool of buffers, whose new buffers are as big as the moving average of the output
+type fun4 struct {
+	// size is first, to be aligned for atomic operations
+	size int64
+	pool sync.Pool
+}
+
+func (p *fun4) get() *bytes.Buffer {
+	if buf, ok := p.pool.Get().(*bytes.Buffer); ok {
+		return buf
+	}
+	return bytes.NewBuffer(make([]byte, 0, atomic.LoadInt64(&p.size)))
+}
+
+// observe moves the size of new buffers an eighth of the way to the size of an output
+func (p *fun4) observe(size int) {
+	old := atomic.LoadInt64(&p.size)
+	if average := old + (int64(size)-old)/8; average != old {
+		atomic.StoreInt64(&p.size, average)
+	}
+}
+
+func (p *fun4) put(buf *bytes.Buffer) {
+	if buf.Cap() <= 1<<20 {
+		buf.Reset()
+		p.pool.Put(buf)
+	}
+}
+
+var fun5 fun4
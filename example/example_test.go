@@ -2,6 +2,7 @@ package example_test
 
 import (
 	"bou.ke/statictemplate/example"
+	"bou.ke/statictemplate/example/buffered"
 	staticTemplate "bou.ke/statictemplate/example/template"
 	"bytes"
 	"fmt"
@@ -29,6 +30,15 @@ func BenchmarkStaticTemplate(b *testing.B) {
 	}
 }
 
+func BenchmarkStaticTemplateBuffered(b *testing.B) {
+	for n := 0; n < b.N; n++ {
+		var b bytes.Buffer
+		if err := buffered.Index(&b, testData); err != nil {
+			panic(err)
+		}
+	}
+}
+
 func BenchmarkDynamicTemplate(b *testing.B) {
 	t := template.Must(template.ParseGlob("./template/*.tmpl"))
 	for n := 0; n < b.N; n++ {
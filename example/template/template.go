@@ -42,12 +42,6 @@ func fun3(w io.Writer, dot pkg1.Post) error {
 	return nil
 }
 
-// footer.tmpl(nil)
-func fun4(w io.Writer, dot interface{}) error {
-	_, _ = io.WriteString(w, "</body>\n</html>\n")
-	return nil
-}
-
 // index.tmpl([]pkg1.Post)
 func fun0(w io.Writer, dot []pkg1.Post) error {
 	if err := fun2(w, "Index"); err != nil {
@@ -65,10 +59,6 @@ func fun0(w io.Writer, dot []pkg1.Post) error {
 			_, _ = io.WriteString(w, "\n")
 		}
 	}
-	_, _ = io.WriteString(w, "\n</section>\n\n")
-	if err := fun4(w, nil); err != nil {
-		return err
-	}
-	_, _ = io.WriteString(w, "\n")
+	_, _ = io.WriteString(w, "\n</section>\n\n</body>\n</html>\n\n")
 	return nil
 }
@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+)
+
+// HandlerEntry is a generated function a handler serves the output of
+type HandlerEntry struct {
+	FunctionName string
+	// Dot is the type of dot as it's written in the generated code
+	Dot string
+	// Size is the constant the buffer is grown by before rendering, if any
+	Size string
+	// Render is a function that renders the output into a pooled *bytes.Buffer,
+	// if any, which the handler puts back into Pool when it's served instead of
+	// rendering into a buffer of its own
+	Render string
+	Pool   string
+}
+
+// ContentType returns the Content-Type of the output of the templates
+func ContentType(html bool) string {
+	if html {
+		return "text/html; charset=utf-8"
+	}
+	return "text/plain; charset=utf-8"
+}
+
+// WriteHandlers writes a function for every entry, named like it with a Handler
+// suffix, that returns an http.Handler serving its output with the dot a loader
+// returns for the request. The output is rendered into a buffer, so a failure
+// is passed to an error handler instead of serving a partial page, and served
+// with an ETag of its hash by http.ServeContent, which answers HEAD and
+// conditional requests. Without an error handler, errors are answered with the
+// status of their StatusCode method, or a 500.
+// The code needs the bytes, errors, hash/fnv, net/http, strconv and time
+// packages.
+func WriteHandlers(w io.Writer, contentType string, withContext bool, entries []HandlerEntry) {
+	var ctxArg string
+	if withContext {
+		ctxArg = "r.Context(), "
+	}
+	for _, entry := range entries {
+		var render string
+		if entry.Render != "" {
+			render = fmt.Sprintf(`buf, err := %s(%sdot)
+		if err != nil {
+			fail(w, r, err)
+			return
+		}
+		defer %s.put(buf)`, entry.Render, ctxArg, entry.Pool)
+		} else {
+			render = "var buf bytes.Buffer"
+			if entry.Size != "" {
+				render += fmt.Sprintf("\n\t\tbuf.Grow(%s)", entry.Size)
+			}
+			render += fmt.Sprintf(`
+		if err := %s(%s&buf, dot); err != nil {
+			fail(w, r, err)
+			return
+		}`, entry.FunctionName, ctxArg)
+		}
+		fmt.Fprintf(w, `
+// %sHandler returns an http.Handler that serves the output of %s, with the
+// dot load returns for the request. Errors are passed to fail, or answered
+// with the status of their StatusCode method, or a 500, when fail is nil.
+func %sHandler(load func(*http.Request) (%s, error), fail func(http.ResponseWriter, *http.Request, error)) http.Handler {
+	if fail == nil {
+		fail = func(w http.ResponseWriter, r *http.Request, err error) {
+			code := http.StatusInternalServerError
+			var status interface{ StatusCode() int }
+			if errors.As(err, &status) {
+				code = status.StatusCode()
+			}
+			http.Error(w, http.StatusText(code), code)
+		}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dot, err := load(r)
+		if err != nil {
+			fail(w, r, err)
+			return
+		}
+		%s
+		hash := fnv.New64a()
+		_, _ = hash.Write(buf.Bytes())
+		w.Header().Set("Content-Type", %q)
+		w.Header().Set("ETag", "\""+strconv.FormatUint(hash.Sum64(), 36)+"\"")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(buf.Bytes()))
+	})
+}
+`, entry.FunctionName, entry.FunctionName, entry.FunctionName, entry.Dot, render, contentType)
+	}
+}
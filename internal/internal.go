@@ -3,68 +3,228 @@ package internal // import "bou.ke/statictemplate/internal"
 import (
 	"fmt"
 	"go/ast"
+	"go/build"
 	"go/token"
 	"go/types"
+	"path/filepath"
 	"regexp"
 	"strconv"
+	"sync"
 
-	"golang.org/x/tools/go/loader"
+	"golang.org/x/tools/go/packages"
 )
 
 var valueReferenceRe = regexp.MustCompile(`^(?:(.+)\.)?([A-Za-z][A-Za-z0-9]*)$`)
 
-func ImportFuncMap(funcMap string) (string, string, map[string]*types.Func, error) {
-	if funcMap == "" {
-		return "", "", nil, nil
+// LoadMode is the information loaded for every package
+const LoadMode = packages.NeedName | packages.NeedFiles | packages.NeedImports | packages.NeedTypes | packages.NeedSyntax | packages.NeedTypesInfo
+
+// funcsPackage has the Funcs map with the functions the generated code calls
+// for the builtin functions of text/template and html/template
+const funcsPackage = "bou.ke/statictemplate/funcs"
+
+var builtins struct {
+	sync.Mutex
+	funcs map[string]*types.Func
+}
+
+// Load loads the packages with the given import paths in a single go/packages
+// invocation. buildFlags are passed on to the go command, e.g. -tags or -mod.
+// The builtin functions are loaded with them, if they aren't loaded yet.
+func Load(buildFlags []string, paths ...string) (map[string]*packages.Package, error) {
+	pkgs, _, err := LoadPatterns(buildFlags, nil, paths...)
+	return pkgs, err
+}
+
+// LoadPatterns is like Load, but loads the packages matched by patterns, like
+// ./stubs, in the same invocation, so their types are identical to the ones of
+// the other packages. It returns them by pattern too, and leaves their errors
+// to the caller.
+func LoadPatterns(buildFlags []string, patterns []string, paths ...string) (map[string]*packages.Package, map[string]*packages.Package, error) {
+	result := make(map[string]*packages.Package)
+	matched := make(map[string]*packages.Package)
+	builtins.Lock()
+	defer builtins.Unlock()
+	if builtins.funcs == nil {
+		paths = append(paths, funcsPackage)
+	}
+	if len(paths) == 0 && len(patterns) == 0 {
+		return result, matched, nil
+	}
+	pkgs, err := packages.Load(&packages.Config{
+		Mode:       LoadMode,
+		BuildFlags: buildFlags,
+	}, append(patterns, paths...)...)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, pattern := range patterns {
+		var matches []*packages.Package
+		for _, pkg := range pkgs {
+			if matchesPattern(pkg, pattern) {
+				matches = append(matches, pkg)
+			}
+		}
+		if len(matches) != 1 {
+			return nil, nil, fmt.Errorf("expected a single package for %q, got %d", pattern, len(matches))
+		}
+		matched[pattern] = matches[0]
 	}
-	var funcMapImport, funcMapName string
+	for _, pkg := range pkgs {
+		result[pkg.PkgPath] = pkg
+	}
+	for _, path := range paths {
+		pkg, ok := result[path]
+		if !ok {
+			return nil, nil, fmt.Errorf("can't find package %q", path)
+		}
+		if !isMatched(pkg, matched) {
+			for _, err := range pkg.Errors {
+				return nil, nil, err
+			}
+		}
+	}
+	if builtins.funcs == nil {
+		if builtins.funcs, err = FuncMap(result[funcsPackage], "Funcs"); err != nil {
+			return nil, nil, err
+		}
+	}
+	return result, matched, nil
+}
+
+// matchesPattern reports whether pkg is the package of a pattern, which is its
+// import path or its directory
+func matchesPattern(pkg *packages.Package, pattern string) bool {
+	if build.IsLocalImport(pattern) || filepath.IsAbs(pattern) {
+		dir, err := filepath.Abs(pattern)
+		return err == nil && pkg.Dir == dir
+	}
+	return pkg.PkgPath == pattern
+}
+
+func isMatched(pkg *packages.Package, matched map[string]*packages.Package) bool {
+	for _, m := range matched {
+		if m == pkg {
+			return true
+		}
+	}
+	return false
+}
+
+// TypesPackages returns the types of the packages, and of the packages they
+// import, by import path
+func TypesPackages(pkgs map[string]*packages.Package) map[string]*types.Package {
+	result := make(map[string]*types.Package)
+	var add func(pkg *types.Package)
+	add = func(pkg *types.Package) {
+		if _, ok := result[pkg.Path()]; ok {
+			return
+		}
+		result[pkg.Path()] = pkg
+		for _, imported := range pkg.Imports() {
+			add(imported)
+		}
+	}
+	for _, pkg := range pkgs {
+		add(pkg.Types)
+	}
+	return result
+}
+
+// Builtins returns the functions the generated code calls for the builtin
+// functions of the templates, loading them if no Load did so yet
+func Builtins() (map[string]*types.Func, error) {
+	builtins.Lock()
+	funcs := builtins.funcs
+	builtins.Unlock()
+	if funcs != nil {
+		return funcs, nil
+	}
+	if _, err := Load(nil); err != nil {
+		return nil, err
+	}
+	builtins.Lock()
+	defer builtins.Unlock()
+	return builtins.funcs, nil
+}
+
+// ParseFuncMapReference splits a <import>.<name> reference to a Funcs map
+func ParseFuncMapReference(funcMap string) (string, string, error) {
 	values := valueReferenceRe.FindStringSubmatch(funcMap)
 	if values == nil || values[1] == "" {
-		return "", "", nil, fmt.Errorf("invalid funcs value %q, expected <import>.<name>", funcMap)
+		return "", "", fmt.Errorf("invalid funcs value %q, expected <import>.<name>", funcMap)
 	}
-	funcMapImport = values[1]
-	funcMapName = values[2]
+	return values[1], values[2], nil
+}
 
-	var conf loader.Config
-	conf.Import(funcMapImport)
-	prog, err := conf.Load()
-	if err != nil {
-		return "", "", nil, err
-	}
-	pack := prog.Package(funcMapImport)
-	var obj *ast.Object
-	for _, f := range pack.Files {
-		if obj = f.Scope.Lookup(funcMapName); obj != nil {
-			break
+// FuncMap finds the Funcs map with the given name in a loaded package and returns its functions
+func FuncMap(pack *packages.Package, funcMapName string) (map[string]*types.Func, error) {
+	var spec *ast.ValueSpec
+	var index int
+	for _, f := range pack.Syntax {
+		for _, decl := range f.Decls {
+			decl, ok := decl.(*ast.GenDecl)
+			if !ok || decl.Tok != token.VAR {
+				continue
+			}
+			for _, s := range decl.Specs {
+				for i, name := range s.(*ast.ValueSpec).Names {
+					if name.Name == funcMapName {
+						spec, index = s.(*ast.ValueSpec), i
+					}
+				}
+			}
 		}
 	}
-	if obj == nil {
-		return "", "", nil, fmt.Errorf("Can't find function map %q", funcMap)
+	if spec == nil || len(spec.Values) <= index {
+		return nil, fmt.Errorf("Can't find function map %q", pack.PkgPath+"."+funcMapName)
+	}
+	lit, ok := spec.Values[index].(*ast.CompositeLit)
+	if !ok {
+		return nil, fmt.Errorf("invalid function map format")
 	}
 
 	funcs := make(map[string]*types.Func)
-	for _, el := range obj.Decl.(*ast.ValueSpec).Values[0].(*ast.CompositeLit).Elts {
+	for _, el := range lit.Elts {
 		ex, ok := el.(*ast.KeyValueExpr)
 		if !ok {
-			return "", "", nil, fmt.Errorf("invalid function map format")
+			return nil, fmt.Errorf("invalid function map format")
 		}
 		lit, ok := ex.Key.(*ast.BasicLit)
 		if !ok || lit.Kind != token.STRING {
-			return "", "", nil, fmt.Errorf("invalid function map format")
+			return nil, fmt.Errorf("invalid function map format")
 		}
 		name, err := strconv.Unquote(lit.Value)
 		if err != nil {
-			return "", "", nil, fmt.Errorf("invalid function map format: %v", err)
+			return nil, fmt.Errorf("invalid function map format: %v", err)
 		}
-		ident, ok := ex.Value.(*ast.Ident)
-		if !ok {
-			return "", "", nil, fmt.Errorf("invalid function map format")
+		var ident *ast.Ident
+		switch value := ex.Value.(type) {
+		case *ast.Ident:
+			ident = value
+		case *ast.SelectorExpr:
+			ident = value.Sel
+		default:
+			return nil, fmt.Errorf("invalid function map format")
 		}
-		if f, ok := pack.Pkg.Scope().Lookup(ident.Name).(*types.Func); ok {
+		if f, ok := pack.TypesInfo.Uses[ident].(*types.Func); ok {
 			funcs[name] = f
 		} else {
-			return "", "", nil, fmt.Errorf("invalid function map format")
+			return nil, fmt.Errorf("invalid function map format")
 		}
 	}
-	return funcMapImport, funcMapName, funcs, nil
+	return funcs, nil
+}
+
+// TakesContext checks whether the function takes a context.Context as its first parameter
+func TakesContext(sig *types.Signature) bool {
+	if sig.Params().Len() == 0 {
+		return false
+	}
+	named, ok := sig.Params().At(0).Type().(*types.Named)
+	if !ok {
+		return false
+	}
+	obj := named.Obj()
+	return obj.Pkg() != nil && obj.Pkg().Path() == "context" && obj.Name() == "Context"
 }
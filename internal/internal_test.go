@@ -0,0 +1,38 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuiltins(t *testing.T) {
+	funcs, err := Builtins()
+	if assert.NoError(t, err) {
+		assert.Equal(t, "Printf", funcs["printf"].Name())
+		assert.Equal(t, "Htmlescaper", funcs["_html_template_htmlescaper"].Name())
+	}
+	pkgs, err := Load(nil, "io")
+	if assert.NoError(t, err) {
+		// The builtins are only loaded once
+		assert.Contains(t, pkgs, "io")
+		assert.NotContains(t, pkgs, funcsPackage)
+	}
+}
+
+func TestLoadPatterns(t *testing.T) {
+	pkgs, matched, err := LoadPatterns(nil, []string{"."}, "golang.org/x/tools/go/packages")
+	if !assert.NoError(t, err) {
+		return
+	}
+	internal := matched["."]
+	if assert.NotNil(t, internal) {
+		assert.Equal(t, "bou.ke/statictemplate/internal", internal.PkgPath)
+		assert.Equal(t, internal, pkgs[internal.PkgPath])
+		// The package imports the same types as the ones that are loaded with it
+		assert.Contains(t, internal.Types.Imports(), pkgs["golang.org/x/tools/go/packages"].Types)
+	}
+
+	_, _, err = LoadPatterns(nil, []string{"./..."})
+	assert.EqualError(t, err, `expected a single package for "./...", got 0`)
+}
@@ -0,0 +1,19 @@
+package internal
+
+import (
+	"strconv"
+	"strings"
+	"text/template/parse"
+)
+
+// Position returns the name the template was parsed with and the position of the
+// node in it. Unlike tree.ErrorContext, the column is 1-based.
+func Position(tree *parse.Tree, node parse.Node) (name string, line, column int) {
+	// The location is formatted as name:line:byte, with a 0-based byte
+	location, _ := tree.ErrorContext(node)
+	i := strings.LastIndexByte(location, ':')
+	j := strings.LastIndexByte(location[:i], ':')
+	line, _ = strconv.Atoi(location[j+1 : i])
+	column, _ = strconv.Atoi(location[i+1:])
+	return location[:j], line, column + 1
+}
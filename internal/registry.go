@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// RegistryEntry is a generated function a registry dispatches to
+type RegistryEntry struct {
+	TemplateName string
+	FunctionName string
+	// Dot is the type of dot as it's written in the generated code
+	Dot string
+	// Type is the type of dot as it's written in error messages, like []example.Post
+	Type string
+}
+
+// WriteRegistry writes a variable with the given name, with ExecuteTemplate and
+// Lookup methods like *template.Template that dispatch to the generated functions
+// by the name of their template and the type of data. The code needs the fmt and
+// io packages, and context if withContext is set.
+func WriteRegistry(w io.Writer, name string, withContext bool, entries []RegistryEntry) {
+	r, size := utf8.DecodeRuneInString(name)
+	prefix := string(unicode.ToLower(r)) + name[size:]
+	var ctxParam, ctxArg string
+	if withContext {
+		ctxParam, ctxArg = "ctx context.Context, ", "ctx, "
+	}
+
+	// Every template gets a case, with a case for each type of dot in it
+	var templateNames []string
+	dots := make(map[string][]RegistryEntry)
+	for _, entry := range entries {
+		if _, ok := dots[entry.TemplateName]; !ok {
+			templateNames = append(templateNames, entry.TemplateName)
+		}
+		var duplicate bool
+		for _, other := range dots[entry.TemplateName] {
+			duplicate = duplicate || other.Dot == entry.Dot
+		}
+		if !duplicate {
+			dots[entry.TemplateName] = append(dots[entry.TemplateName], entry)
+		}
+	}
+
+	fmt.Fprintf(w, `
+// %s executes the generated functions by the name of their template, like
+// (*template.Template).ExecuteTemplate
+var %s %sRegistry
+
+type %sRegistry struct{}
+
+// ExecuteTemplate executes the function generated for the template with the
+// given name and the type of data
+func (%sRegistry) ExecuteTemplate(%sw io.Writer, name string, data interface{}) error {
+	switch name {
+`, name, name, prefix, prefix, prefix, ctxParam)
+	for _, templateName := range templateNames {
+		fmt.Fprintf(w, "case %q:\nswitch dot := data.(type) {\n", templateName)
+		var types []string
+		var pointers []RegistryEntry
+		for _, entry := range dots[templateName] {
+			fmt.Fprintf(w, "case %s:\nreturn %s(%sw, dot)\n", entry.Dot, entry.FunctionName, ctxArg)
+			types = append(types, entry.Type)
+			if strings.HasPrefix(entry.Dot, "*") {
+				pointers = append(pointers, entry)
+			}
+		}
+		// Templates execute with a nil dot, which is a nil pointer if there's only one type it can be
+		if len(pointers) == 1 {
+			fmt.Fprintf(w, "case nil:\nreturn %s(%sw, nil)\n", pointers[0].FunctionName, ctxArg)
+		}
+		fmt.Fprintf(w, "}\nreturn fmt.Errorf(\"template: %%s: expected data of type %s, got %%T\", name, data)\n", strings.Replace(strings.Join(types, " or "), "%", "%%", -1))
+	}
+	fmt.Fprintf(w, `}
+	return fmt.Errorf("template: no template %%q associated with %s", name)
+}
+
+// Lookup returns the template with the given name, or nil if no function is generated for it
+func (%sRegistry) Lookup(name string) *%sTemplate {
+	switch name {
+	case %s:
+		return &%sTemplate{name: name}
+	}
+	return nil
+}
+
+// %sTemplate is a template in %s
+type %sTemplate struct {
+	name string
+}
+
+// Name returns the name of the template
+func (t *%sTemplate) Name() string {
+	return t.name
+}
+
+// Execute executes the function generated for the template and the type of data
+func (t *%sTemplate) Execute(%sw io.Writer, data interface{}) error {
+	return %s.ExecuteTemplate(%sw, t.name, data)
+}
+`, name, prefix, prefix, quoteAll(templateNames), prefix, prefix, name, prefix, prefix, prefix, ctxParam, name, ctxArg)
+}
+
+func quoteAll(values []string) string {
+	quoted := make([]string, len(values))
+	for i, value := range values {
+		quoted[i] = fmt.Sprintf("%q", value)
+	}
+	return strings.Join(quoted, ", ")
+}
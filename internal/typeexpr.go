@@ -0,0 +1,137 @@
+package internal
+
+import (
+	"fmt"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"regexp"
+	"strings"
+)
+
+// qualifiedNameRe matches a reference to a name in a package, using the full
+// import path of the package, e.g. bou.ke/statictemplate/example.Post
+var qualifiedNameRe = regexp.MustCompile(`([\w\-~./]+)\.([A-Za-z_]\w*)`)
+
+// TypeExpr is a Go type expression which refers to packages by their full
+// import path instead of by package name, e.g. map[string]bou.ke/statictemplate/example.Post
+type TypeExpr struct {
+	// Source is the type expression as written
+	Source string
+	// Imports lists the import paths referenced by the expression, in order of appearance
+	Imports []string
+}
+
+// ParseTypeExpr parses a type expression with fully-qualified import paths
+func ParseTypeExpr(source string) (TypeExpr, error) {
+	expr := TypeExpr{Source: source}
+	seen := make(map[string]bool)
+	for _, match := range qualifiedNameRe.FindAllStringSubmatch(source, -1) {
+		if !seen[match[1]] {
+			seen[match[1]] = true
+			expr.Imports = append(expr.Imports, match[1])
+		}
+	}
+	if _, err := parser.ParseExpr(expr.Format(placeholderAlias(expr.Imports))); err != nil {
+		return TypeExpr{}, fmt.Errorf("invalid type expression %q: %v", source, err)
+	}
+	return expr, nil
+}
+
+func placeholderAlias(imports []string) func(string) string {
+	return func(path string) string {
+		for i, p := range imports {
+			if p == path {
+				return fmt.Sprintf("_pkg%d", i)
+			}
+		}
+		panic("unknown import " + path)
+	}
+}
+
+// Format returns the expression as Go code, using alias to name the imported
+// packages. Names are left unqualified if alias returns an empty string.
+func (e TypeExpr) Format(alias func(path string) string) string {
+	return qualifiedNameRe.ReplaceAllStringFunc(e.Source, func(match string) string {
+		values := qualifiedNameRe.FindStringSubmatch(match)
+		if name := alias(values[1]); name != "" {
+			return name + "." + values[2]
+		}
+		return values[2]
+	})
+}
+
+// Eval type-checks the expression against the given packages, which must
+// include every package in Imports
+func (e TypeExpr) Eval(pkgs map[string]*types.Package) (types.Type, error) {
+	scope := types.NewPackage("bou.ke/statictemplate/internal/typeexpr", "typeexpr")
+	for i, path := range e.Imports {
+		pkg, ok := pkgs[path]
+		if !ok {
+			return nil, fmt.Errorf("package %q is not loaded", path)
+		}
+		scope.Scope().Insert(types.NewPkgName(token.NoPos, scope, fmt.Sprintf("_pkg%d", i), pkg))
+	}
+	tv, err := types.Eval(token.NewFileSet(), scope, token.NoPos, e.Format(placeholderAlias(e.Imports)))
+	if err != nil {
+		// Refer to the packages by their import path again
+		message := err.Error()
+		for i := len(e.Imports) - 1; i >= 0; i-- {
+			message = strings.Replace(message, fmt.Sprintf("_pkg%d", i), e.Imports[i], -1)
+		}
+		return nil, fmt.Errorf("%s: %s", e.Source, message)
+	}
+	if !tv.IsType() {
+		return nil, fmt.Errorf("%s is not a type", e.Source)
+	}
+	return tv.Type, nil
+}
+
+// Implementations maps type expressions of interface types to the type
+// expressions of the concrete types their values can have
+type Implementations map[string][]string
+
+// Imports returns the import paths the type expressions refer to
+func (i Implementations) Imports() ([]string, error) {
+	var paths []string
+	for iface, implementations := range i {
+		for _, source := range append([]string{iface}, implementations...) {
+			expr, err := ParseTypeExpr(source)
+			if err != nil {
+				return nil, err
+			}
+			paths = append(paths, expr.Imports...)
+		}
+	}
+	return paths, nil
+}
+
+// Eval type-checks the type expressions against the given packages, which
+// must include every package in Imports
+func (i Implementations) Eval(pkgs map[string]*types.Package) (map[types.Type][]types.Type, error) {
+	eval := func(source string) (types.Type, error) {
+		expr, err := ParseTypeExpr(source)
+		if err != nil {
+			return nil, err
+		}
+		return expr.Eval(pkgs)
+	}
+	result := make(map[types.Type][]types.Type)
+	for iface, implementations := range i {
+		key, err := eval(iface)
+		if err != nil {
+			return nil, err
+		}
+		if !types.IsInterface(key) {
+			return nil, fmt.Errorf("%s is not an interface type", iface)
+		}
+		for _, implementation := range implementations {
+			typ, err := eval(implementation)
+			if err != nil {
+				return nil, err
+			}
+			result[key] = append(result[key], typ)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,32 @@
+package internal
+
+import (
+	"go/types"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTypeExprFormat(t *testing.T) {
+	dot, err := ParseTypeExpr("map[string][]*bou.ke/whatever.Page[text/template.Template]")
+	if assert.NoError(t, err) {
+		aliases := map[string]string{"bou.ke/whatever": "pkg0", "text/template": "pkg1"}
+		assert.Equal(t, "map[string][]*pkg0.Page[pkg1.Template]", dot.Format(func(path string) string {
+			return aliases[path]
+		}))
+	}
+}
+
+func TestTypeExprEval(t *testing.T) {
+	dot, err := ParseTypeExpr("map[string][4]chan bou.ke/whatever.Post")
+	if assert.NoError(t, err) {
+		p := types.NewPackage("bou.ke/whatever", "whatever")
+		p.Scope().Insert(types.NewTypeName(0, p, "Post", types.Typ[types.String]))
+		typ, err := dot.Eval(map[string]*types.Package{"bou.ke/whatever": p})
+		if assert.NoError(t, err) {
+			assert.Equal(t, "map[string][4]chan string", typ.String())
+		}
+		_, err = dot.Eval(nil)
+		assert.EqualError(t, err, `package "bou.ke/whatever" is not loaded`)
+	}
+}
@@ -2,6 +2,7 @@ package main // import "bou.ke/statictemplate"
 
 import (
 	"bytes"
+	"errors"
 	"flag"
 	"fmt"
 	"go/format"
@@ -10,26 +11,25 @@ import (
 	"log"
 	"os"
 	"path/filepath"
-	"regexp"
+	"strings"
 
 	htmlTemplate "html/template"
 	textTemplate "text/template"
 
 	"bou.ke/statictemplate/internal"
 	"bou.ke/statictemplate/statictemplate"
-	"golang.org/x/tools/go/loader"
+	"golang.org/x/tools/go/packages"
 )
 
-type dotType struct {
-	packagePath string
-	typeName    string
-	prefix      string
-}
-
 type compilationTarget struct {
 	functionName string
 	templateName string
-	dot          dotType
+	dot          internal.TypeExpr
+
+	// typ is the type of dot, if it was already resolved from a stub
+	typ types.Type
+	// assign is the name of the stub variable the function is assigned to
+	assign string
 }
 
 type compilationTargets []compilationTarget
@@ -38,47 +38,94 @@ func (c *compilationTargets) String() string {
 	return ""
 }
 
-var typeNameRe = regexp.MustCompile(`^([^:]+):([^:]+):([\*\[\]]*)(?:(.+)\.)?([A-Za-z][A-Za-z0-9]*)$`)
-
 func (c *compilationTargets) Set(value string) error {
-	values := typeNameRe.FindStringSubmatch(value)
-	if values == nil {
+	values := splitTarget(value)
+	if len(values) != 3 || values[0] == "" || values[1] == "" || values[2] == "" {
 		return fmt.Errorf("expect compilation target in functionName:templateName:typeName format, got %q", value)
 	}
-	*c = append(*c, compilationTarget{values[1], values[2], dotType{
-		prefix:      values[3],
-		packagePath: values[4],
-		typeName:    values[5],
-	}})
+	dot, err := internal.ParseTypeExpr(values[2])
+	if err != nil {
+		return err
+	}
+	*c = append(*c, compilationTarget{functionName: values[0], templateName: values[1], dot: dot})
 	return nil
 }
 
-func (c compilationTargets) ToInstructions() (ins []statictemplate.TranslateInstruction, err error) {
-	var conf loader.Config
-	conf.Import("runtime")
-	for _, t := range c {
-		if p := t.dot.packagePath; p != "" {
-			conf.Import(p)
+// splitTarget splits a target into its function name, template name and type.
+// The template name can be a pattern with colons, like /^(?:a|b)\.tmpl$/, so the
+// function name is split off the front and the type, which has none, off the
+// back. The function name of a pattern is a template, whose actions can have
+// colons too, like {{ $base := .Base }}.
+func splitTarget(value string) []string {
+	var inAction bool
+	for i := 0; i < len(value); i++ {
+		switch {
+		case strings.HasPrefix(value[i:], "{{"):
+			inAction = true
+			i++
+		case strings.HasPrefix(value[i:], "}}"):
+			inAction = false
+			i++
+		case value[i] == ':' && !inAction:
+			functionName, rest := value[:i], value[i+1:]
+			j := strings.LastIndex(rest, ":")
+			if j == -1 {
+				return []string{functionName, rest}
+			}
+			return []string{functionName, rest[:j], rest[j+1:]}
 		}
 	}
-	var prog *loader.Program
-	prog, err = conf.Load()
-	if err != nil {
-		return
+	return []string{value}
+}
+
+// implementations maps interface types to the concrete types their values can
+// have, as type expressions like the dot of a target
+type implementations map[string][]string
+
+func (i *implementations) String() string {
+	return ""
+}
+
+func (i *implementations) Set(value string) error {
+	values := strings.SplitN(value, ":", 2)
+	if len(values) != 2 || values[0] == "" || values[1] == "" {
+		return fmt.Errorf("expect implementation in interfaceType:typeName format, got %q", value)
+	}
+	for _, source := range values {
+		if _, err := internal.ParseTypeExpr(source); err != nil {
+			return err
+		}
+	}
+	if *i == nil {
+		*i = make(implementations)
 	}
+	(*i)[values[0]] = append((*i)[values[0]], values[1])
+	return nil
+}
+
+// PackagePaths returns the import paths of the packages the targets refer to
+func (c compilationTargets) PackagePaths() (paths []string) {
 	for _, t := range c {
-		var pack *types.Package
-		if t.dot.packagePath != "" {
-			pack = prog.Package(t.dot.packagePath).Pkg
+		if t.typ == nil {
+			paths = append(paths, t.dot.Imports...)
 		}
-		typVal, err := types.Eval(conf.Fset, pack, 0, t.dot.prefix+t.dot.typeName)
-		if err != nil {
-			return nil, err
+	}
+	return
+}
+
+func (c compilationTargets) ToInstructions(pkgs map[string]*packages.Package) (ins []statictemplate.TranslateInstruction, err error) {
+	typesPkgs := internal.TypesPackages(pkgs)
+	for _, t := range c {
+		typ := t.typ
+		if typ == nil {
+			if typ, err = t.dot.Eval(typesPkgs); err != nil {
+				return nil, err
+			}
 		}
 		ins = append(ins, statictemplate.TranslateInstruction{
 			FunctionName: t.functionName,
 			TemplateName: t.templateName,
-			Dot:          typVal.Type,
+			Dot:          typ,
 		})
 	}
 	return
@@ -86,24 +133,86 @@ func (c compilationTargets) ToInstructions() (ins []statictemplate.TranslateInst
 
 var (
 	targets       compilationTargets
+	impls         implementations
 	packageName   string
 	outputFile    string
 	devOutputFile string
+	devCheck      bool
 	glob          string
 	html          bool
+	delims        string
+	missingKey    string
+	parseMode     string
 	funcMap       string
+	withContext   bool
+	registry      string
+	fallback      bool
+	variants      string
+	sizes         bool
+	averageSizes  string
+	staticBytes   bool
+	inline        int
+	handlers      bool
+	buffered      bool
+	buildTags     string
+	modFlag       string
+	configFile    string
+	stubs         string
+	sourcePackage string
+	rewrite       bool
+	checkOnly     bool
+	vetOnly       bool
+	watchMode     bool
+	templateRoot  string
+	jsonOutput    bool
 )
 
 func init() {
-	flag.Var(&targets, "t", "Target to process, supports multiple. The format is <function name>:<template name>:<type of the template argument>")
+	flag.Var(&targets, "t", "Target to process, supports multiple. The format is <function name>:<template name>:<type of the template argument>. The template name can be a glob or a /regexp/ to generate a function for every matching template, named by a function name template like Render{{.Base}}")
 	flag.StringVar(&packageName, "package", "", "Name of the package of the result file. Defaults to name of the folder of the output file")
 	flag.StringVar(&outputFile, "o", "template.go", "Name of the output file")
 	flag.StringVar(&devOutputFile, "dev", "", "Name of the dev output file")
+	flag.BoolVar(&devCheck, "devcheck", false, "Type check the templates against the targets in the dev output whenever they're parsed. The Go packages are loaded with the go command at runtime, so the dev build has to run from the module it was built in")
 	flag.BoolVar(&html, "html", false, "Interpret templates as HTML, to enable Go's automatic HTML escaping")
+	flag.StringVar(&delims, "delims", "", "Action delimiters of the templates, separated by a space, like \"[[ ]]\"")
+	flag.StringVar(&missingKey, "missingkey", "", "What to do when a template indexes a map with a missing key: zero for the zero value, or error. Defaults to zero")
+	flag.StringVar(&parseMode, "parsemode", "", "Comma-separated list of modes to parse the templates with: comments to keep comments in the parse tree, skipfunccheck to leave unknown functions to the type check")
 	flag.StringVar(&funcMap, "funcs", "", "A reference to a custom Funcs map to include")
+	flag.BoolVar(&withContext, "context", false, "Generate functions that take a context.Context as their first argument")
+	flag.StringVar(&registry, "registry", "", "Name of a variable to generate with ExecuteTemplate and Lookup methods like *template.Template, that execute the generated functions by template name")
+	flag.BoolVar(&fallback, "fallback", false, "Execute the parts of templates that can't be translated with text/template at runtime, instead of failing. They're listed on stderr")
+	flag.StringVar(&variants, "variants", "", "Comma-separated list of companions to generate for every function: string for <function>String(dot) (string, error), append for <function>Append(dst []byte, dot) ([]byte, error)")
+	flag.BoolVar(&sizes, "sizes", false, "Generate a <function>MinSize constant with the minimum size of the output of every function, and presize the buffers of the String and Append companions with it")
+	flag.StringVar(&averageSizes, "averagesizes", "", "Comma-separated list of average output sizes in <function>=<bytes> format, to generate <function>AverageSize constants and presize the buffers of the String and Append companions with, like Index=48213")
+	flag.BoolVar(&staticBytes, "staticbytes", false, "Write static text from package-level []byte variables, instead of string constants that are converted for io.Writers without a WriteString method")
+	flag.IntVar(&inline, "inline", 0, "Maximum number of parse tree nodes of a template for {{template}} calls to it to be inlined into the caller, instead of calling its function. Defaults to 0, which disables inlining")
+	flag.BoolVar(&handlers, "handlers", false, "Generate a <function>Handler(load func(*http.Request) (dot, error), fail func(http.ResponseWriter, *http.Request, error)) http.Handler for every function, that serves the output with a Content-Type and an ETag")
+	flag.BoolVar(&buffered, "buffered", false, "Render into a pooled buffer, and only write the output when the template succeeds, so an error doesn't leave half of it written")
+	flag.Var(&impls, "impl", "Concrete type the values of an interface type can have, supports multiple. The format is <interface type>:<type>. Templates executed with a dot of the interface type are generated for each of its types")
+	flag.StringVar(&buildTags, "tags", "", "Comma-separated list of build tags to apply when loading packages")
+	flag.StringVar(&modFlag, "mod", "", "Module download mode to use when loading packages: readonly, vendor, or mod")
+	flag.StringVar(&stubs, "stubs", "", "A package with function stubs annotated with //statictemplate:template <template name> to generate")
+	flag.StringVar(&sourcePackage, "source", "", "A package with templates parsed from constant strings, annotated with // statictemplate: func=<function name> dot=<type>, to generate")
+	flag.BoolVar(&rewrite, "rewrite", false, "Replace Execute and ExecuteTemplate calls on the templates of the -source package with calls to the generated functions")
+	flag.BoolVar(&checkOnly, "check", false, "Don't write the output files, but exit with a diff if they're not up to date")
+	flag.BoolVar(&watchMode, "watch", false, "Keep running, and regenerate the output when the templates or the Go packages they use change")
+	flag.StringVar(&templateRoot, "root", "", "Directory the template globs are relative to. Templates are named by their slash-separated path in it, in both the generated code and the dev output, instead of their base name")
+	flag.StringVar(&configFile, "config", "", "A JSON file declaring groups of templates and targets to generate. Flags that are passed in explicitly override it")
+}
+
+// templateName returns the name of the template parsed from file. Templates are
+// named by their base name, or by their slash-separated path in root if it's set.
+func templateName(root, file string) string {
+	if root == "" {
+		return filepath.Base(file)
+	}
+	if rel, err := filepath.Rel(root, file); err == nil {
+		return filepath.ToSlash(rel)
+	}
+	return filepath.ToSlash(file)
 }
 
-func parse(html bool, funcs map[string]*types.Func, files ...string) (interface{}, error) {
+func parseTemplates(html bool, funcs map[string]*types.Func, options statictemplate.ParseOptions, root string, files ...string) (interface{}, error) {
 	var dummyFuncs map[string]interface{}
 	if funcs != nil {
 		dummyFuncs = make(map[string]interface{})
@@ -113,123 +222,523 @@ func parse(html bool, funcs map[string]*types.Func, files ...string) (interface{
 			}
 		}
 	}
+	var names []string
+	if root != "" {
+		for _, file := range files {
+			names = append(names, templateName(root, file))
+		}
+	}
+	var t interface{}
 	if html {
-		t := htmlTemplate.New("")
+		htmlTemp := htmlTemplate.New("")
 		if dummyFuncs != nil {
-			t.Funcs(dummyFuncs)
+			htmlTemp.Funcs(dummyFuncs)
 		}
-		return t.ParseFiles(files...)
+		t = htmlTemp
 	} else {
-		t := textTemplate.New("")
+		textTemp := textTemplate.New("")
 		if dummyFuncs != nil {
-			t.Funcs(dummyFuncs)
+			textTemp.Funcs(dummyFuncs)
 		}
-		return t.ParseFiles(files...)
+		t = textTemp
+	}
+	var err error
+	switch {
+	case len(files) == 0:
+		// The templates are all in Go source
+	case root != "":
+		err = options.ParseFS(t, os.DirFS(root), names...)
+	default:
+		err = options.ParseFiles(t, files...)
+	}
+	return t, err
+}
+
+func (c *config) buildFlags(extraTags ...string) []string {
+	var flags []string
+	if tags := strings.Join(append(strings.Split(c.Tags, ","), extraTags...), ","); strings.Trim(tags, ",") != "" {
+		flags = append(flags, "-tags="+strings.Trim(tags, ","))
 	}
+	if c.Mod != "" {
+		flags = append(flags, "-mod="+c.Mod)
+	}
+	return flags
 }
 
 func main() {
-	flag.Parse()
-	if len(targets) == 0 || flag.NArg() < 1 {
-		flag.Usage()
-		os.Exit(2)
+	if len(os.Args) > 1 && os.Args[1] == "vet" {
+		// statictemplate vet [flags] [templates] takes the same flags, but only reports problems
+		vetOnly = true
+		flag.BoolVar(&jsonOutput, "json", false, "Print the problems found by vet as JSON")
+		flag.CommandLine.Parse(os.Args[2:])
+	} else {
+		flag.Parse()
+	}
+
+	var c *config
+	if configFile != "" {
+		var err error
+		if c, err = loadConfig(configFile); err != nil {
+			log.Fatal(err)
+		}
+		if err = c.applyFlags(); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		if flag.NArg() < 1 && sourcePackage == "" {
+			flag.Usage()
+			os.Exit(2)
+		}
+		c = flagConfig()
 	}
 
-	if err := work(); err != nil {
+	if watchMode {
+		watch(c)
+		return
+	}
+	if err := work(c); err == errOutdated || err == errProblems {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	} else if err != nil {
 		log.Fatal(err)
 	}
 }
 
-func work() error {
-	if packageName == "" {
-		absOutputFile, err := filepath.Abs(outputFile)
+func work(c *config) error {
+	pkgs, err := load(c)
+	if err != nil {
+		return err
+	}
+	return output(c, pkgs)
+}
+
+// load resolves the groups and loads the packages they refer to. The stubs
+// and source packages are loaded together with the other packages, so the
+// types they have in common are identical.
+func load(c *config) (map[string]*packages.Package, error) {
+	var patterns []string
+	var withStubs bool
+	for _, g := range c.Groups {
+		g.buildFlags = c.buildFlags()
+		if err := g.resolveTemplates(); err != nil {
+			return nil, err
+		}
+		if g.Stubs != "" {
+			patterns = append(patterns, g.Stubs)
+			withStubs = true
+		}
+		if g.Source != "" {
+			patterns = append(patterns, g.Source)
+		}
+	}
+	paths, err := c.packagePaths()
+	if err != nil {
+		return nil, err
+	}
+	buildFlags := c.buildFlags()
+	if withStubs {
+		// The stubs are in files that are only built with the stub build tag,
+		// which excludes the generated code
+		buildFlags = c.buildFlags(stubBuildTag)
+	}
+	// Load the packages of all groups at once
+	pkgs, matched, err := internal.LoadPatterns(buildFlags, patterns, paths...)
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range c.Groups {
+		if g.Stubs != "" {
+			if err := g.loadStubs(matched[g.Stubs]); err != nil {
+				return nil, err
+			}
+		}
+		if g.Source != "" {
+			if err := g.loadSource(matched[g.Source]); err != nil {
+				return nil, err
+			}
+		}
+		if err := g.resolve(); err != nil {
+			return nil, err
+		}
+	}
+	return pkgs, nil
+}
+
+// packagePaths returns the import paths of the packages the groups refer to.
+// The types of the targets declared in the stubs and source packages are
+// found in the packages they import instead.
+func (c *config) packagePaths() ([]string, error) {
+	var paths []string
+	for _, g := range c.Groups {
+		paths = append(paths, g.templateTargets.PackagePaths()...)
+		paths = append(paths, g.Targets.PackagePaths()...)
+		implementationPaths, err := internal.Implementations(g.Implementations).Imports()
 		if err != nil {
-			return err
+			return nil, err
+		}
+		paths = append(paths, implementationPaths...)
+		if g.Funcs != "" {
+			funcMapImport, _, err := internal.ParseFuncMapReference(g.Funcs)
+			if err != nil {
+				return nil, err
+			}
+			paths = append(paths, funcMapImport)
 		}
-		packageName = filepath.Base(filepath.Dir(absOutputFile))
 	}
+	return paths, nil
+}
 
-	var templateFiles []string
-	for i := 0; i < flag.NArg(); i++ {
-		matches, err := filepath.Glob(flag.Arg(i))
+// output generates the files of the groups and writes them, or checks or vets them
+func output(c *config, pkgs map[string]*packages.Package) error {
+	if vetOnly {
+		return vet(c.Groups, pkgs)
+	}
+
+	var files []generatedFile
+	for _, g := range c.Groups {
+		generated, err := g.generate(pkgs)
 		if err != nil {
 			return err
 		}
-		templateFiles = append(templateFiles, matches...)
+		files = append(files, generated...)
+	}
+
+	if checkOnly {
+		var outdated bool
+		for _, f := range files {
+			diff, err := f.check()
+			if err != nil {
+				return err
+			}
+			if diff != "" {
+				outdated = true
+				os.Stdout.WriteString(diff)
+			}
+		}
+		if outdated {
+			return errOutdated
+		}
+		return nil
 	}
-	if len(templateFiles) == 0 {
-		log.Fatal("no files found matching glob")
+	for _, f := range files {
+		if err := f.write(); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	funcMapImport, funcMapName, funcs, err := internal.ImportFuncMap(funcMap)
+var errOutdated = errors.New("generated files are out of date")
+
+// loadStubs finds the targets declared in the loaded stubs package
+func (g *outputGroup) loadStubs(pkg *packages.Package) error {
+	if err := checkStubErrors(pkg); err != nil {
+		return err
+	}
+	targets, withContext, err := stubTargets(pkg)
 	if err != nil {
 		return err
 	}
-
-	var buf bytes.Buffer
-	if devOutputFile != "" {
-		buf.WriteString("// +build !dev\n\n")
+	if len(targets) != 0 {
+		if g.contextSet && g.Context != withContext {
+			return fmt.Errorf("the stubs in %s don't match -context=%v", pkg.PkgPath, g.Context)
+		}
+		g.Context = withContext
+	}
+	g.stubTargets = targets
+	g.stubFiles = pkg.GoFiles
+	g.packagePath = pkg.PkgPath
+	if g.Package == "" {
+		g.Package = pkg.Name
 	}
+	return nil
+}
 
-	template, err := parse(html, funcs, templateFiles...)
+// loadSource finds the templates in the loaded source package
+func (g *outputGroup) loadSource(pkg *packages.Package) error {
+	sources, targets, err := sourceTemplates(pkg)
 	if err != nil {
 		return err
 	}
+	generated := make(map[string]bool)
+	for _, target := range targets {
+		generated[target.functionName] = true
+	}
+	for _, err := range pkg.Errors {
+		// Rewritten calls refer to the generated functions, which may not exist yet
+		if !isUndefinedError(err, generated) {
+			return err
+		}
+	}
+	for _, source := range sources {
+		if source.html != g.HTML {
+			kind, flag := "text/template", "with"
+			if source.html {
+				kind, flag = "html/template", "without"
+			}
+			return fmt.Errorf("template %s in %s uses %s, but the templates are generated %s -html", source.name, pkg.PkgPath, kind, flag)
+		}
+	}
+	if g.packagePath != "" && g.packagePath != pkg.PkgPath {
+		return fmt.Errorf("the source package %s must be the package of the stubs, %s", pkg.PkgPath, g.packagePath)
+	}
+	g.sourcePackage = pkg
+	g.sources = sources
+	g.sourceTargets = targets
+	g.packagePath = pkg.PkgPath
+	if g.Package == "" {
+		g.Package = pkg.Name
+	}
+	return nil
+}
 
-	translator := statictemplate.New(template)
-	translator.Funcs = funcs
-	ins, err := targets.ToInstructions()
+// globs returns the patterns of the templates, relative to the working directory
+func (g *outputGroup) globs() []string {
+	if g.Root == "" {
+		return g.Templates
+	}
+	globs := make([]string, len(g.Templates))
+	for i, pattern := range g.Templates {
+		globs[i] = filepath.Join(g.Root, pattern)
+	}
+	return globs
+}
+
+// resolveTemplates finds the template files of the group, and the targets
+// declared in them
+func (g *outputGroup) resolveTemplates() error {
+	g.templateFiles = nil
+	for _, pattern := range g.globs() {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return err
+		}
+		g.templateFiles = append(g.templateFiles, matches...)
+	}
+
+	options, err := g.parseOptions()
 	if err != nil {
 		return err
 	}
-	byts, err := translator.Translate(packageName, ins)
+	g.templateTargets = nil
+	if vetOnly {
+		// vet reports invalid annotations together with the other problems, and
+		// parse errors when it parses the templates itself
+		g.discoveryErrors = nil
+		for _, file := range g.templateFiles {
+			targets, invalid, err := discoverAnnotations(g.Root, options, []string{file})
+			if err == nil {
+				g.templateTargets = append(g.templateTargets, targets...)
+				g.discoveryErrors = append(g.discoveryErrors, invalid...)
+			}
+		}
+		return nil
+	}
+	g.templateTargets, err = discoverTargets(g.Root, options, g.templateFiles)
+	return err
+}
+
+// resolve merges the targets declared in the templates, stubs and source with
+// the explicit ones. The templates have to be resolved first.
+func (g *outputGroup) resolve() error {
+	if len(g.templateFiles) == 0 && len(g.sources) == 0 {
+		return fmt.Errorf("no files found matching glob %q", g.Templates)
+	}
+	options, err := g.parseOptions()
 	if err != nil {
 		return err
 	}
-	buf.Write(byts)
+	var discovered compilationTargets
+	discovered = append(discovered, g.templateTargets...)
+	discovered = append(append(discovered, g.stubTargets...), g.sourceTargets...)
 
-	src, err := format.Source(buf.Bytes())
+	// Explicit targets can be patterns that match the names of the templates,
+	// including the ones defined in them
+	names := definedTemplateNames(g.Root, options, g.templateFiles)
+	for _, source := range g.sources {
+		names = append(names, source.name)
+	}
+	explicit, err := expandTargets(g.Targets, names)
 	if err != nil {
 		return err
 	}
+	g.targets = mergeTargets(discovered, explicit)
+	if len(g.targets) == 0 {
+		return fmt.Errorf("no targets given for %q, pass them in with -t or declare them in the templates", g.Templates)
+	}
+	return nil
+}
 
-	if err := os.MkdirAll(filepath.Dir(outputFile), 0755); err != nil {
-		return err
+func (g *outputGroup) generate(pkgs map[string]*packages.Package) ([]generatedFile, error) {
+	packageName := g.Package
+	if packageName == "" {
+		absOutputFile, err := filepath.Abs(g.Output)
+		if err != nil {
+			return nil, err
+		}
+		packageName = filepath.Base(filepath.Dir(absOutputFile))
 	}
+	templateFiles := g.templateFiles
 
-	file, err := os.Create(outputFile)
+	var funcMapImport, funcMapName string
+	var funcs map[string]*types.Func
+	if g.Funcs != "" {
+		var err error
+		if funcMapImport, funcMapName, err = internal.ParseFuncMapReference(g.Funcs); err != nil {
+			return nil, err
+		}
+		if funcs, err = internal.FuncMap(pkgs[funcMapImport], funcMapName); err != nil {
+			return nil, err
+		}
+	}
+
+	var buf bytes.Buffer
+	var constraints []string
+	if g.Dev != "" {
+		constraints = append(constraints, "!dev")
+	}
+	if g.Stubs != "" {
+		constraints = append(constraints, "!"+stubBuildTag)
+	}
+	if len(constraints) != 0 {
+		fmt.Fprintf(&buf, "// +build %s\n\n", strings.Join(constraints, ","))
+	}
+
+	options, err := g.parseOptions()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	template, err := parseTemplates(g.HTML, funcs, options, g.Root, templateFiles...)
+	if err != nil {
+		return nil, err
+	}
+	if err = addSourceTemplates(template, g.sources, options.Mode); err != nil {
+		return nil, err
 	}
 
-	if _, err = file.Write(src); err != nil {
-		return err
+	translator := statictemplate.New(template)
+	translator.Funcs = funcs
+	translator.Context = g.Context
+	translator.PackagePath = g.packagePath
+	translator.MissingKey = g.MissingKey
+	translator.Registry = g.Registry
+	translator.Fallback = g.Fallback
+	if translator.String, translator.Append, err = g.variants(); err != nil {
+		return nil, err
+	}
+	if translator.Implementations, err = g.implementations(pkgs); err != nil {
+		return nil, err
+	}
+	if translator.AverageSizes, err = g.averageSizes(); err != nil {
+		return nil, err
+	}
+	translator.Sizes = g.Sizes || translator.AverageSizes != nil
+	translator.StaticBytes = g.StaticBytes
+	translator.Inline = g.Inline
+	translator.Handlers = g.Handlers
+	translator.Buffered = g.Buffered
+	g.minSizes = nil
+	if translator.Sizes {
+		for _, target := range g.targets {
+			minSize, err := statictemplate.MinSize(template, target.templateName)
+			if err != nil {
+				return nil, err
+			}
+			g.minSizes = append(g.minSizes, minSize)
+		}
+	}
+	ins, err := g.targets.ToInstructions(pkgs)
+	if err != nil {
+		return nil, err
+	}
+	byts, err := translator.Translate(packageName, ins)
+	if err != nil {
+		return nil, err
+	}
+	for _, fallback := range translator.Fallbacks {
+		fmt.Fprintln(os.Stderr, fallback)
+	}
+	buf.Write(byts)
+	writeStubAssignments(&buf, g.targets)
+
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	files := []generatedFile{{name: g.Output, src: src}}
+
+	if g.Rewrite && g.sourcePackage != nil {
+		if g.Context {
+			return nil, fmt.Errorf("calls can't be rewritten with -context, as the generated functions need a context.Context")
+		}
+		rewritten, err := rewriteSource(g.sourcePackage, g.sources, g.targets, pkgs)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, rewritten...)
 	}
-	file.Close()
 
-	if devOutputFile != "" {
+	if g.Dev != "" {
 		buf.Reset()
-		if err = writeDevTemplate(&buf, targets, templateFiles, html, funcMapImport, funcMapName, packageName); err != nil {
-			return err
+		if err = writeDevTemplate(&buf, g, ins, funcs, funcMapImport, funcMapName, packageName); err != nil {
+			return nil, err
 		}
 		src, err := format.Source(buf.Bytes())
 		if err != nil {
-			return err
+			return nil, err
 		}
+		files = append(files, generatedFile{name: g.Dev, src: src, skipUnchanged: true})
+	}
+	return files, nil
+}
 
-		if contents, err := ioutil.ReadFile(devOutputFile); err != nil || !bytes.Equal(contents, src) {
-			if err := os.MkdirAll(filepath.Dir(devOutputFile), 0755); err != nil {
-				return err
-			}
-			file, err := os.Create(devOutputFile)
-			if err != nil {
-				return err
-			}
-			if _, err = file.Write(src); err != nil {
-				return err
-			}
-			file.Close()
+// implementations resolves the implementations of the group against the loaded packages
+func (g *outputGroup) implementations(pkgs map[string]*packages.Package) (map[types.Type][]types.Type, error) {
+	return internal.Implementations(g.Implementations).Eval(internal.TypesPackages(pkgs))
+}
+
+// generatedFile is the contents of an output file
+type generatedFile struct {
+	name string
+	src  []byte
+	// skipUnchanged leaves the file alone if it's already up to date
+	skipUnchanged bool
+}
+
+func (f generatedFile) write() error {
+	if f.skipUnchanged {
+		if contents, err := ioutil.ReadFile(f.name); err == nil && bytes.Equal(contents, f.src) {
+			return nil
 		}
 	}
-	return nil
+	dir := filepath.Dir(f.name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	// Write to a temporary file and rename it, so the output is never half-written
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(f.name)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(f.src); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.name)
+}
+
+// check returns a diff between the file on disk and the generated contents
+func (f generatedFile) check() (string, error) {
+	contents, err := ioutil.ReadFile(f.name)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	return internal.Diff(f.name, f.name+" (generated)", contents, f.src), nil
 }
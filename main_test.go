@@ -1,8 +1,10 @@
 package main
 
 import (
-	"gopkg.in/stretchr/testify.v1/assert"
 	"testing"
+
+	"bou.ke/statictemplate/internal"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestParseCompilationTargets(t *testing.T) {
@@ -11,48 +13,96 @@ func TestParseCompilationTargets(t *testing.T) {
 	assert.NoError(t, ct.Set("Hello:hi.tmpl:*text/template.Template"))
 	assert.NoError(t, ct.Set("Cool:hi.tmpl:text/template.Template"))
 	assert.NoError(t, ct.Set("Neat:hi.tmpl:*bou.ke/whatever.Template"))
+	assert.NoError(t, ct.Set("Map:hi.tmpl:map[string]bou.ke/whatever.Post"))
+	assert.NoError(t, ct.Set("Generic:hi.tmpl:bou.ke/whatever.Page[bou.ke/whatever.Post]"))
+	assert.NoError(t, ct.Set("Chan:hi.tmpl:chan gopkg.in/yaml.v2.Node"))
 	expected := compilationTargets{
 		compilationTarget{
 			functionName: "Hi",
 			templateName: "hi.tmpl",
-			dot: dotType{
-				packagePath: "",
-				typeName:    "string",
-				prefix:      "",
-			},
+			dot:          internal.TypeExpr{Source: "string"},
 		},
 		compilationTarget{
 			functionName: "Hello",
 			templateName: "hi.tmpl",
-			dot: dotType{
-				packagePath: "text/template",
-				typeName:    "Template",
-				prefix:      "*",
+			dot: internal.TypeExpr{
+				Source:  "*text/template.Template",
+				Imports: []string{"text/template"},
 			},
 		},
 		compilationTarget{
 			functionName: "Cool",
 			templateName: "hi.tmpl",
-			dot: dotType{
-				packagePath: "text/template",
-				typeName:    "Template",
-				prefix:      "",
+			dot: internal.TypeExpr{
+				Source:  "text/template.Template",
+				Imports: []string{"text/template"},
 			},
 		},
 		compilationTarget{
 			functionName: "Neat",
 			templateName: "hi.tmpl",
-			dot: dotType{
-				packagePath: "bou.ke/whatever",
-				typeName:    "Template",
-				prefix:      "*",
+			dot: internal.TypeExpr{
+				Source:  "*bou.ke/whatever.Template",
+				Imports: []string{"bou.ke/whatever"},
+			},
+		},
+		compilationTarget{
+			functionName: "Map",
+			templateName: "hi.tmpl",
+			dot: internal.TypeExpr{
+				Source:  "map[string]bou.ke/whatever.Post",
+				Imports: []string{"bou.ke/whatever"},
+			},
+		},
+		compilationTarget{
+			functionName: "Generic",
+			templateName: "hi.tmpl",
+			dot: internal.TypeExpr{
+				Source:  "bou.ke/whatever.Page[bou.ke/whatever.Post]",
+				Imports: []string{"bou.ke/whatever"},
+			},
+		},
+		compilationTarget{
+			functionName: "Chan",
+			templateName: "hi.tmpl",
+			dot: internal.TypeExpr{
+				Source:  "chan gopkg.in/yaml.v2.Node",
+				Imports: []string{"gopkg.in/yaml.v2"},
 			},
 		},
 	}
 	assert.Equal(t, expected, ct)
 }
 
+func TestParseCompilationTargetsColons(t *testing.T) {
+	var ct compilationTargets
+	assert.NoError(t, ct.Set(`Render{{.Base}}:/^(?:a|b)\.tmpl$/:string`))
+	assert.NoError(t, ct.Set(`{{ $base := .Base }}Render{{ $base }}:partials/*.tmpl:map[string]bou.ke/whatever.Post`))
+	if assert.Len(t, ct, 2) {
+		assert.Equal(t, "Render{{.Base}}", ct[0].functionName)
+		assert.Equal(t, `/^(?:a|b)\.tmpl$/`, ct[0].templateName)
+		assert.Equal(t, "string", ct[0].dot.Source)
+		assert.Equal(t, "{{ $base := .Base }}Render{{ $base }}", ct[1].functionName)
+		assert.Equal(t, "partials/*.tmpl", ct[1].templateName)
+		assert.Equal(t, "map[string]bou.ke/whatever.Post", ct[1].dot.Source)
+	}
+}
+
 func TestParseCompilationTargetsError(t *testing.T) {
 	var ct compilationTargets
-	assert.Error(t, ct.Set("lol whatever man"), `expect compilation target in functionName:templateName:typeName format, got "lol whatever man"`)
+	assert.EqualError(t, ct.Set("lol whatever man"), `expect compilation target in functionName:templateName:typeName format, got "lol whatever man"`)
+	assert.Error(t, ct.Set("Hi:hi.tmpl:map[string"))
+}
+
+func TestParseImplementations(t *testing.T) {
+	var impls implementations
+	assert.NoError(t, impls.Set("bou.ke/widgets.Widget:bou.ke/widgets.Chart"))
+	assert.NoError(t, impls.Set("bou.ke/widgets.Widget:*bou.ke/widgets.Table"))
+	assert.NoError(t, impls.Set("interface{}:string"))
+	assert.Equal(t, implementations{
+		"bou.ke/widgets.Widget": {"bou.ke/widgets.Chart", "*bou.ke/widgets.Table"},
+		"interface{}":           {"string"},
+	}, impls)
+	assert.EqualError(t, impls.Set("bou.ke/widgets.Widget"), `expect implementation in interfaceType:typeName format, got "bou.ke/widgets.Widget"`)
+	assert.Error(t, impls.Set("bou.ke/widgets.Widget:map[string"))
 }
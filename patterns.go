@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/token"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"unicode"
+)
+
+// targetName is the data the function name of a pattern target is executed with
+type targetName struct {
+	// Name is the name of the template, like partials/user-card.tmpl
+	Name string
+	// Base is the base name of the template without its extension as an identifier, like UserCard
+	Base string
+	// Path is the name of the template without its extension as an identifier, like PartialsUserCard
+	Path string
+	// Matches are the submatches of a regular expression pattern, starting with the whole name
+	Matches []string
+}
+
+var targetNameFuncs = template.FuncMap{
+	"camel": camel,
+}
+
+// isTemplatePattern reports whether the template of a target is a glob, like
+// partials/*.tmpl, or a regular expression between slashes, like /^partials/(.*)\.tmpl$/
+func isTemplatePattern(templateName string) bool {
+	return isRegexpPattern(templateName) || strings.ContainsAny(templateName, "*?[")
+}
+
+func isRegexpPattern(templateName string) bool {
+	return len(templateName) > 2 && strings.HasPrefix(templateName, "/") && strings.HasSuffix(templateName, "/")
+}
+
+// expandTargets replaces the targets whose template is a pattern with a target
+// for every template name matching it. Their function names are generated by
+// executing the function name as a template with a targetName. Targets that
+// aren't patterns override generated ones with the same function name.
+func expandTargets(targets compilationTargets, names []string) (compilationTargets, error) {
+	explicit := make(map[string]bool)
+	for _, t := range targets {
+		if !isTemplatePattern(t.templateName) {
+			explicit[t.functionName] = true
+		}
+	}
+	sorted := append([]string(nil), names...)
+	sort.Strings(sorted)
+
+	var expanded compilationTargets
+	generated := make(map[string]string)
+	for _, t := range targets {
+		if !isTemplatePattern(t.templateName) {
+			expanded = append(expanded, t)
+			continue
+		}
+		match, err := templateMatcher(t.templateName)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.Contains(t.functionName, "{{") {
+			return nil, fmt.Errorf("target for pattern %s needs a function name that depends on the template, like Render{{.Base}}, got %s", t.templateName, t.functionName)
+		}
+		nameTemplate, err := template.New(t.functionName).Funcs(targetNameFuncs).Option("missingkey=error").Parse(t.functionName)
+		if err != nil {
+			return nil, fmt.Errorf("invalid function name for pattern %s: %v", t.templateName, err)
+		}
+
+		var matched bool
+		for _, name := range sorted {
+			matches := match(name)
+			if matches == nil {
+				continue
+			}
+			matched = true
+			var buf bytes.Buffer
+			if err := nameTemplate.Execute(&buf, targetName{
+				Name:    name,
+				Base:    camel(strings.TrimSuffix(path.Base(name), path.Ext(name))),
+				Path:    camel(strings.TrimSuffix(name, path.Ext(name))),
+				Matches: matches,
+			}); err != nil {
+				return nil, err
+			}
+			functionName := buf.String()
+			if !token.IsIdentifier(functionName) {
+				return nil, fmt.Errorf("function name %s for template %s isn't a valid identifier", functionName, name)
+			}
+			if explicit[functionName] {
+				continue
+			}
+			if other, ok := generated[functionName]; ok {
+				return nil, fmt.Errorf("function name %s is generated for both %s and %s", functionName, other, name)
+			}
+			generated[functionName] = name
+			expanded = append(expanded, compilationTarget{functionName: functionName, templateName: name, dot: t.dot, typ: t.typ})
+		}
+		if !matched {
+			return nil, fmt.Errorf("no templates match %s", t.templateName)
+		}
+	}
+	return expanded, nil
+}
+
+// templateMatcher returns a function that returns the submatches of a template
+// name, or nil if it doesn't match the pattern. Globs match the whole name like
+// a regular expression without groups.
+func templateMatcher(pattern string) (func(string) []string, error) {
+	if isRegexpPattern(pattern) {
+		re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return nil, err
+		}
+		return re.FindStringSubmatch, nil
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid pattern %s: %v", pattern, err)
+	}
+	return func(name string) []string {
+		if ok, _ := path.Match(pattern, name); ok {
+			return []string{name}
+		}
+		return nil
+	}, nil
+}
+
+// camel converts a name like user-card or user_card to an exported identifier like UserCard
+func camel(name string) string {
+	var b strings.Builder
+	upper := true
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			upper = true
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
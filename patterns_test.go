@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpandTargets(t *testing.T) {
+	names := []string{"index.tmpl", "partials/user-card.tmpl", "partials/header.tmpl", "partials/footer.html"}
+	var targets compilationTargets
+	assert.NoError(t, targets.Set("Render{{.Base}}:partials/*.tmpl:string"))
+	assert.NoError(t, targets.Set(`{{index .Matches 1 | camel}}Page:/^(.*)\.html$/:int`))
+	assert.NoError(t, targets.Set("RenderHeader:index.tmpl:string"))
+
+	expanded, err := expandTargets(targets, names)
+	if assert.NoError(t, err) && assert.Len(t, expanded, 3) {
+		// The explicit RenderHeader target overrides the one generated for partials/header.tmpl
+		assert.Equal(t, "RenderUserCard", expanded[0].functionName)
+		assert.Equal(t, "partials/user-card.tmpl", expanded[0].templateName)
+		assert.Equal(t, "string", expanded[0].dot.Source)
+		assert.Equal(t, "PartialsFooterPage", expanded[1].functionName)
+		assert.Equal(t, "partials/footer.html", expanded[1].templateName)
+		assert.Equal(t, "int", expanded[1].dot.Source)
+		assert.Equal(t, "RenderHeader", expanded[2].functionName)
+		assert.Equal(t, "index.tmpl", expanded[2].templateName)
+	}
+}
+
+func TestExpandTargetsError(t *testing.T) {
+	names := []string{"a/index.tmpl", "b/index.tmpl"}
+	for _, c := range []struct {
+		target, err string
+	}{
+		{"Render:*/*.tmpl:string", "target for pattern */*.tmpl needs a function name that depends on the template, like Render{{.Base}}, got Render"},
+		{"Render{{.Base}}:*/*.tmpl:string", "function name RenderIndex is generated for both a/index.tmpl and b/index.tmpl"},
+		{"Render{{.Name}}:*/*.tmpl:string", "function name Rendera/index.tmpl for template a/index.tmpl isn't a valid identifier"},
+		{"Render{{.Path}}:c/*.tmpl:string", "no templates match c/*.tmpl"},
+	} {
+		var targets compilationTargets
+		assert.NoError(t, targets.Set(c.target))
+		_, err := expandTargets(targets, names)
+		assert.EqualError(t, err, c.err, c.target)
+	}
+}
+
+func TestCamel(t *testing.T) {
+	assert.Equal(t, "UserCard", camel("user-card"))
+	assert.Equal(t, "UserCard", camel("user_card"))
+	assert.Equal(t, "PartialsIndex", camel("partials/index"))
+	assert.Equal(t, "404", camel("404"))
+}
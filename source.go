@@ -0,0 +1,360 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/constant"
+	"go/format"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"text/template/parse"
+
+	"bou.ke/statictemplate/statictemplate"
+	"golang.org/x/tools/go/packages"
+)
+
+// sourceTemplate is a template parsed from a constant string in Go source
+type sourceTemplate struct {
+	name string
+	text string
+	html bool
+	// leftDelim and rightDelim are set if the template is created with a Delims call
+	leftDelim, rightDelim string
+	// file, line and column are the position of the text, if it's a single
+	// string literal so positions in the template map to positions in the file
+	file         string
+	line, column int
+	// variable is the package-level variable the template is assigned to, if any
+	variable *types.Var
+}
+
+// position returns the position in the Go source of a position in the template
+func (s sourceTemplate) position(line, column int) (string, int, int) {
+	if s.file == "" {
+		return s.name, line, column
+	}
+	if line == 1 && column != 0 {
+		column += s.column - 1
+	}
+	return s.file, s.line + line - 1, column
+}
+
+// isUndefinedError reports whether err is only about the undefined names in defined
+func isUndefinedError(err packages.Error, defined map[string]bool) bool {
+	for _, line := range strings.Split(err.Msg, "\n") {
+		i := strings.LastIndex(line, "undefined: ")
+		if !strings.HasPrefix(line, "#") && (i < 0 || !defined[line[i+len("undefined: "):]]) {
+			return false
+		}
+	}
+	return true
+}
+
+// sourceTemplates finds the templates parsed from constant strings that are annotated like
+//
+//	// statictemplate: func=Row dot=bou.ke/statictemplate/example.Post
+//	var row = template.Must(template.New("row").Parse(`<li>{{.Title}}</li>`))
+//
+// with the annotation on the line above the call, and returns them with the targets they declare
+func sourceTemplates(pkg *packages.Package) ([]sourceTemplate, compilationTargets, error) {
+	var sources []sourceTemplate
+	var targets compilationTargets
+	for _, file := range pkg.Syntax {
+		// Annotations apply to the call on the line below them
+		annotations := make(map[int]*ast.Comment)
+		for _, group := range file.Comments {
+			for _, comment := range group.List {
+				if text := strings.TrimPrefix(comment.Text, "//"); strings.HasPrefix(strings.TrimSpace(text), annotationPrefix) {
+					annotations[pkg.Fset.Position(comment.End()).Line+1] = comment
+				}
+			}
+		}
+		if len(annotations) == 0 {
+			continue
+		}
+		variables := packageVariables(pkg.TypesInfo, file)
+
+		var err error
+		ast.Inspect(file, func(node ast.Node) bool {
+			call, ok := node.(*ast.CallExpr)
+			if !ok || err != nil {
+				return err == nil
+			}
+			line := pkg.Fset.Position(call.Pos()).Line
+			comment, ok := annotations[line]
+			if !ok {
+				return true
+			}
+			var source sourceTemplate
+			if source, ok, err = parseSourceTemplate(pkg, call); err != nil || !ok {
+				return err == nil
+			}
+			delete(annotations, line)
+			source.variable = variables[call]
+
+			var target compilationTarget
+			if target, _, err = parseAnnotation(source.name, strings.TrimPrefix(comment.Text, "//")); err != nil {
+				err = fmt.Errorf("%s: %v", pkg.Fset.Position(comment.Pos()), err)
+				return false
+			}
+			sources = append(sources, source)
+			targets = append(targets, target)
+			return false
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if len(annotations) != 0 {
+			lines := make([]int, 0, len(annotations))
+			for line := range annotations {
+				lines = append(lines, line)
+			}
+			sort.Ints(lines)
+			return nil, nil, fmt.Errorf("%s: annotation isn't followed by a call like template.Must(template.New(name).Parse(text))", pkg.Fset.Position(annotations[lines[0]].Pos()))
+		}
+	}
+	return sources, targets, nil
+}
+
+// parseSourceTemplate matches a template.Must(template.New(name).Parse(text)) call,
+// where Funcs, Option and Delims calls can come between New and Parse
+func parseSourceTemplate(pkg *packages.Package, call *ast.CallExpr) (source sourceTemplate, ok bool, err error) {
+	must, html := templateFunc(pkg.TypesInfo, call.Fun)
+	if must == nil || must.Name() != "Must" || isMethod(must) {
+		return sourceTemplate{}, false, nil
+	}
+	source.html = html
+	errorf := func(format string, args ...interface{}) (sourceTemplate, bool, error) {
+		return sourceTemplate{}, false, fmt.Errorf("%s: %s", pkg.Fset.Position(call.Pos()), fmt.Sprintf(format, args...))
+	}
+
+	parseCall, ok := unparen(call.Args[0]).(*ast.CallExpr)
+	if !ok {
+		return errorf("template.Must must be called with the result of Parse")
+	}
+	if f, _ := templateFunc(pkg.TypesInfo, parseCall.Fun); f == nil || f.Name() != "Parse" || !isMethod(f) {
+		return errorf("template.Must must be called with the result of Parse")
+	}
+	if source.text, ok = constantString(pkg.TypesInfo, parseCall.Args[0]); !ok {
+		return errorf("the text of the template must be a constant string")
+	}
+	if lit, ok := unparen(parseCall.Args[0]).(*ast.BasicLit); ok && (lit.Value[0] == '`' || !strings.Contains(lit.Value, `\`)) {
+		// Positions in the template only map to the file if the text is written out as is
+		position := pkg.Fset.Position(lit.Pos())
+		source.file, source.line, source.column = position.Filename, position.Line, position.Column+1
+	}
+
+	receiver := parseCall.Fun.(*ast.SelectorExpr).X
+	var delimsSet bool
+	for {
+		call, ok := unparen(receiver).(*ast.CallExpr)
+		if !ok {
+			return errorf("the template must be created with template.New")
+		}
+		f, _ := templateFunc(pkg.TypesInfo, call.Fun)
+		switch {
+		case f != nil && f.Name() == "New" && !isMethod(f):
+			if source.name, ok = constantString(pkg.TypesInfo, call.Args[0]); !ok {
+				return errorf("the name of the template must be a constant string")
+			}
+			return source, true, nil
+		case f != nil && (f.Name() == "Funcs" || f.Name() == "Option") && isMethod(f):
+		case f != nil && f.Name() == "Delims" && isMethod(f):
+			left, leftOK := constantString(pkg.TypesInfo, call.Args[0])
+			right, rightOK := constantString(pkg.TypesInfo, call.Args[1])
+			if !leftOK || !rightOK {
+				return errorf("the delimiters of the template must be constant strings")
+			}
+			// The last call to Delims before Parse is the one that counts
+			if !delimsSet {
+				source.leftDelim, source.rightDelim, delimsSet = left, right, true
+			}
+		default:
+			return errorf("the template must be created with template.New, followed by Funcs, Option or Delims calls")
+		}
+		receiver = call.Fun.(*ast.SelectorExpr).X
+	}
+}
+
+// templateFunc returns the function or method of text/template or html/template
+// that expr refers to, or nil if it doesn't refer to one
+func templateFunc(info *types.Info, expr ast.Expr) (f *types.Func, html bool) {
+	sel, ok := unparen(expr).(*ast.SelectorExpr)
+	if !ok {
+		return nil, false
+	}
+	if f, ok = info.Uses[sel.Sel].(*types.Func); !ok || f.Pkg() == nil {
+		return nil, false
+	}
+	switch f.Pkg().Path() {
+	case "text/template":
+		return f, false
+	case "html/template":
+		return f, true
+	}
+	return nil, false
+}
+
+func isMethod(f *types.Func) bool {
+	return f.Type().(*types.Signature).Recv() != nil
+}
+
+func constantString(info *types.Info, expr ast.Expr) (string, bool) {
+	value := info.Types[expr].Value
+	if value == nil || value.Kind() != constant.String {
+		return "", false
+	}
+	return constant.StringVal(value), true
+}
+
+func unparen(expr ast.Expr) ast.Expr {
+	for {
+		paren, ok := expr.(*ast.ParenExpr)
+		if !ok {
+			return expr
+		}
+		expr = paren.X
+	}
+}
+
+// packageVariables returns the package-level variables the calls in the file are assigned to
+func packageVariables(info *types.Info, file *ast.File) map[*ast.CallExpr]*types.Var {
+	variables := make(map[*ast.CallExpr]*types.Var)
+	for _, decl := range file.Decls {
+		decl, ok := decl.(*ast.GenDecl)
+		if !ok || decl.Tok != token.VAR {
+			continue
+		}
+		for _, spec := range decl.Specs {
+			spec := spec.(*ast.ValueSpec)
+			if len(spec.Names) != len(spec.Values) {
+				continue
+			}
+			for i, value := range spec.Values {
+				call, ok := unparen(value).(*ast.CallExpr)
+				if v, isVar := info.Defs[spec.Names[i]].(*types.Var); ok && isVar {
+					variables[call] = v
+				}
+			}
+		}
+	}
+	return variables
+}
+
+// addSourceTemplates parses the source templates into template, with their own delimiters
+func addSourceTemplates(template interface{}, sources []sourceTemplate, mode parse.Mode) error {
+	for _, source := range sources {
+		options := statictemplate.ParseOptions{LeftDelim: source.leftDelim, RightDelim: source.rightDelim, Mode: mode}
+		if err := options.Parse(template, source.name, source.text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rewriteSource replaces calls to Execute and ExecuteTemplate on the variables of
+// the source templates with calls to the generated functions. Calls are only
+// rewritten if the type of the argument matches the type of dot of the target.
+func rewriteSource(pkg *packages.Package, sources []sourceTemplate, targets compilationTargets, pkgs map[string]*packages.Package) ([]generatedFile, error) {
+	ins, err := targets.ToInstructions(pkgs)
+	if err != nil {
+		return nil, err
+	}
+	functions := make(map[string]int)
+	for i, target := range targets {
+		functions[target.templateName] = i
+	}
+	// Execute runs the template the variable was created with
+	variables := make(map[*types.Var]string)
+	for _, source := range sources {
+		if source.variable != nil {
+			variables[source.variable] = source.name
+		}
+	}
+
+	var files []generatedFile
+	for _, file := range pkg.Syntax {
+		type edit struct {
+			start, end int
+			text       string
+		}
+		var edits []edit
+		name := pkg.Fset.File(file.Pos()).Name()
+		contents, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		offset := func(pos token.Pos) int {
+			return pkg.Fset.Position(pos).Offset
+		}
+		text := func(expr ast.Expr) string {
+			return string(contents[offset(expr.Pos()):offset(expr.End())])
+		}
+
+		ast.Inspect(file, func(node ast.Node) bool {
+			call, ok := node.(*ast.CallExpr)
+			if !ok {
+				return true
+			}
+			method, _ := templateFunc(pkg.TypesInfo, call.Fun)
+			if method == nil || !isMethod(method) {
+				return true
+			}
+			ident, ok := unparen(call.Fun.(*ast.SelectorExpr).X).(*ast.Ident)
+			if !ok {
+				return true
+			}
+			v, _ := pkg.TypesInfo.Uses[ident].(*types.Var)
+			templateName, ok := variables[v]
+			if !ok {
+				return true
+			}
+			switch {
+			case method.Name() == "Execute" && len(call.Args) == 2:
+			case method.Name() == "ExecuteTemplate" && len(call.Args) == 3:
+				if templateName, ok = constantString(pkg.TypesInfo, call.Args[1]); !ok {
+					return true
+				}
+			default:
+				return true
+			}
+			i, ok := functions[templateName]
+			dot := call.Args[len(call.Args)-1]
+			if !ok || !matchesDot(pkg.TypesInfo.TypeOf(dot), ins[i].Dot) {
+				return true
+			}
+			edits = append(edits, edit{
+				start: offset(call.Pos()),
+				end:   offset(call.End()),
+				text:  fmt.Sprintf("%s(%s, %s)", targets[i].functionName, text(call.Args[0]), text(dot)),
+			})
+			return true
+		})
+		if len(edits) == 0 {
+			continue
+		}
+
+		sort.Slice(edits, func(i, j int) bool {
+			return edits[i].start > edits[j].start
+		})
+		src := contents
+		for _, e := range edits {
+			src = append(append(append([]byte{}, src[:e.start]...), e.text...), src[e.end:]...)
+		}
+		if src, err = format.Source(src); err != nil {
+			return nil, err
+		}
+		files = append(files, generatedFile{name: name, src: src})
+	}
+	return files, nil
+}
+
+// matchesDot reports whether a value of type typ can be passed as dot
+func matchesDot(typ, dot types.Type) bool {
+	return typ != nil && types.AssignableTo(typ, dot)
+}
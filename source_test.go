@@ -0,0 +1,174 @@
+package main
+
+import (
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/tools/go/packages"
+)
+
+func checkSource(t *testing.T, name, src string) *packages.Package {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, name, src, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := &types.Info{
+		Types: make(map[ast.Expr]types.TypeAndValue),
+		Defs:  make(map[*ast.Ident]types.Object),
+		Uses:  make(map[*ast.Ident]types.Object),
+	}
+	conf := types.Config{Importer: importer.Default(), Error: func(error) {}}
+	pkg, _ := conf.Check("bou.ke/source", fset, []*ast.File{file}, info)
+	return &packages.Package{
+		PkgPath:   "bou.ke/source",
+		Fset:      fset,
+		Syntax:    []*ast.File{file},
+		Types:     pkg,
+		TypesInfo: info,
+	}
+}
+
+const sourceFile = `package source
+
+import (
+	"io"
+	"text/template"
+)
+
+// statictemplate: func=Row dot=string
+var row = template.Must(template.New("row").Funcs(template.FuncMap{}).Parse(` + "`<li>{{.}}</li>`" + `))
+
+const listText = "{{range .}}{{.}}{{end}}"
+
+func render(w io.Writer, names []string) error {
+	// statictemplate: func=List dot=[]string
+	list := template.Must(template.New("list").Parse(listText))
+	if err := row.Execute(w, names[0]); err != nil {
+		return err
+	}
+	if err := row.Execute(w, names); err != nil {
+		return err
+	}
+	return list.Execute(w, names)
+}
+`
+
+func TestSourceTemplates(t *testing.T) {
+	pkg := checkSource(t, "source.go", sourceFile)
+	sources, targets, err := sourceTemplates(pkg)
+	if !assert.NoError(t, err) || !assert.Len(t, sources, 2) || !assert.Len(t, targets, 2) {
+		return
+	}
+	assert.Equal(t, "row", sources[0].name)
+	assert.Equal(t, "<li>{{.}}</li>", sources[0].text)
+	assert.False(t, sources[0].html)
+	assert.Equal(t, "row", sources[0].variable.Name())
+	file, line, column := sources[0].position(1, 5)
+	assert.Equal(t, "source.go", file)
+	assert.Equal(t, 9, line)
+	assert.Equal(t, 82, column)
+	assert.Equal(t, "Row", targets[0].functionName)
+	assert.Equal(t, "row", targets[0].templateName)
+
+	assert.Equal(t, "list", sources[1].name)
+	assert.Equal(t, "{{range .}}{{.}}{{end}}", sources[1].text)
+	assert.Nil(t, sources[1].variable)
+	assert.Equal(t, "", sources[1].file)
+	assert.Equal(t, "List", targets[1].functionName)
+	assert.Equal(t, "[]string", targets[1].dot.Source)
+}
+
+func TestSourceTemplatesError(t *testing.T) {
+	pkg := checkSource(t, "source.go", `package source
+
+import "text/template"
+
+var text = "{{.}}"
+
+// statictemplate: func=Row dot=string
+var row = template.Must(template.New("row").Parse(text))
+`)
+	_, _, err := sourceTemplates(pkg)
+	assert.EqualError(t, err, "source.go:8:11: the text of the template must be a constant string")
+
+	pkg = checkSource(t, "source.go", `package source
+
+// statictemplate: func=Row dot=string
+var row = "{{.}}"
+`)
+	_, _, err = sourceTemplates(pkg)
+	assert.EqualError(t, err, "source.go:3:1: annotation isn't followed by a call like template.Must(template.New(name).Parse(text))")
+}
+
+func TestRewriteSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statictemplate")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "source.go")
+	assert.NoError(t, ioutil.WriteFile(name, []byte(sourceFile), 0644))
+
+	pkg := checkSource(t, name, sourceFile)
+	sources, targets, err := sourceTemplates(pkg)
+	if !assert.NoError(t, err) {
+		return
+	}
+	files, err := rewriteSource(pkg, sources, targets, nil)
+	if assert.NoError(t, err) && assert.Len(t, files, 1) {
+		assert.Equal(t, name, files[0].name)
+		// Only package-level variables are rewritten, and only if dot has the right type
+		assert.Contains(t, string(files[0].src), `	if err := Row(w, names[0]); err != nil {
+		return err
+	}
+	if err := row.Execute(w, names); err != nil {
+		return err
+	}
+	return list.Execute(w, names)
+`)
+	}
+}
+
+func TestSourceTemplatesDelims(t *testing.T) {
+	pkg := checkSource(t, "source.go", `package source
+
+import "html/template"
+
+// statictemplate: func=Row dot=string
+var row = template.Must(template.New("row").Delims("[[", "]]").Parse("<li>[[.]]</li>"))
+`)
+	sources, _, err := sourceTemplates(pkg)
+	if assert.NoError(t, err) && assert.Len(t, sources, 1) {
+		assert.True(t, sources[0].html)
+		assert.Equal(t, "[[", sources[0].leftDelim)
+		assert.Equal(t, "]]", sources[0].rightDelim)
+	}
+}
+
+func TestMatchesDot(t *testing.T) {
+	p := types.NewPackage("bou.ke/source", "source")
+	stringer := types.NewInterfaceType([]*types.Func{
+		types.NewFunc(0, p, "String", types.NewSignature(nil, nil, types.NewTuple(types.NewVar(0, p, "", types.Typ[types.String])), false)),
+	}, nil).Complete()
+	name := types.NewNamed(types.NewTypeName(0, p, "Name", nil), types.Typ[types.String], nil)
+	name.AddMethod(types.NewFunc(0, p, "String", types.NewSignature(types.NewVar(0, p, "", name), nil, types.NewTuple(types.NewVar(0, p, "", types.Typ[types.String])), false)))
+
+	assert.True(t, matchesDot(types.Typ[types.String], types.Typ[types.String]))
+	assert.True(t, matchesDot(types.Typ[types.Int], types.NewInterfaceType(nil, nil)))
+	assert.True(t, matchesDot(name, stringer))
+	assert.False(t, matchesDot(types.Typ[types.String], stringer))
+	assert.False(t, matchesDot(name, types.Typ[types.String]))
+	assert.False(t, matchesDot(nil, stringer))
+	// A type with the same name from another load isn't the same type
+	other := types.NewNamed(types.NewTypeName(0, types.NewPackage("bou.ke/source", "source"), "Name", nil), types.Typ[types.String], nil)
+	assert.False(t, matchesDot(other, name))
+}
@@ -0,0 +1,100 @@
+package statictemplate
+
+import (
+	"go/types"
+	"testing"
+	"text/template"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuffered(t *testing.T) {
+	temp := template.Must(template.New("index.tmpl").Parse(`<p>{{ . }}</p>`))
+	translator := New(temp)
+	translator.Buffered = true
+	translator.Sizes = true
+	actual, err := translator.Translate("main", []TranslateInstruction{
+		{"Index", "index.tmpl", types.Typ[types.String]},
+	})
+	if assert.NoError(t, err) {
+		equalish(t, `
+package main
+
+import (
+  "bytes"
+  "io"
+  "sync"
+  "sync/atomic"
+)
+
+func Index(w io.Writer, dot string) error {
+  buf, err := fun3(dot)
+  if err != nil {
+    return err
+  }
+  defer fun2.put(buf)
+  _, err = w.Write(buf.Bytes())
+  return err
+}
+
+// fun3 renders Index into a buffer from fun2, which the caller puts back
+func fun3(dot string) (buf *bytes.Buffer, err error) {
+  defer func() {
+    if recovered := recover(); recovered != nil {
+      var ok bool
+      if err, ok = recovered.(error); !ok {
+        panic(recovered)
+      }
+    }
+  }()
+  buf = fun2.get()
+  if err = fun0(buf, dot); err != nil {
+    fun2.put(buf)
+    return nil, err
+  }
+  fun2.observe(buf.Len())
+  return buf, nil
+}
+
+const IndexMinSize = 7
+
+// index.tmpl(string)
+func fun0(w io.Writer, dot string) error {
+  _, _ = io.WriteString(w, "<p>")
+  _, _ = io.WriteString(w, dot)
+  _, _ = io.WriteString(w, "</p>")
+  return nil
+}
+
+// fun1 is a pool of buffers, whose new buffers are as big as the moving average of the output
+type fun1 struct {
+  // size is first, to be aligned for atomic operations
+  size int64
+  pool sync.Pool
+}
+
+func (p *fun1) get() *bytes.Buffer {
+  if buf, ok := p.pool.Get().(*bytes.Buffer); ok {
+    return buf
+  }
+  return bytes.NewBuffer(make([]byte, 0, atomic.LoadInt64(&p.size)))
+}
+
+// observe moves the size of new buffers an eighth of the way to the size of an output
+func (p *fun1) observe(size int) {
+  old := atomic.LoadInt64(&p.size)
+  if average := old + (int64(size)-old)/8; average != old {
+    atomic.StoreInt64(&p.size, average)
+  }
+}
+
+func (p *fun1) put(buf *bytes.Buffer) {
+  if buf.Cap() <= 1<<20 {
+    buf.Reset()
+    p.pool.Put(buf)
+  }
+}
+
+var fun2 = fun1{size: IndexMinSize}`, actual, "buffered")
+	}
+}
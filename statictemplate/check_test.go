@@ -0,0 +1,53 @@
+package statictemplate
+
+import (
+	"go/types"
+	"testing"
+	"text/template"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheck(t *testing.T) {
+	structAB := types.NewStruct([]*types.Var{
+		types.NewVar(0, nil, "A", types.Typ[types.Int]),
+		types.NewVar(0, nil, "B", types.NewSlice(types.Typ[types.String])),
+	}, nil)
+	temp := template.Must(template.New("template.tmpl").Funcs(template.FuncMap{
+		"bogus": func() string { return "" },
+	}).Parse(`{{ .Missing }}
+{{ range .A }}{{ end }}
+{{ printf .A }}
+{{ $x := .Nope }}{{ $x.Length }}
+{{ bogus }}{{ .B }}
+{{ range .B }}{{ template "other" . }}{{ end }}
+{{ template "other" "again" }}
+{{ template "missing" }}
+{{ define "other" }}{{ .Foo }}{{ end }}`))
+
+	errs := checkTemplate(t, temp, structAB)
+	assert.Equal(t, []string{
+		"template.tmpl:1:4: unknown field Missing for type struct{A int; B []string}",
+		"template.tmpl:2:10: range can't iterate over int",
+		"template.tmpl:3:11: wrong type for value; expected string; got int",
+		"template.tmpl:4:10: unknown field Nope for type struct{A int; B []string}",
+		"template.tmpl:5:4: unknown function bogus",
+		"template.tmpl:9:24: unknown field Foo for type string",
+		`template.tmpl:8:13: template: no such template "missing"`,
+	}, errs)
+}
+
+func TestCheckValid(t *testing.T) {
+	temp := template.Must(template.New("template.tmpl").Parse(`{{ printf "%d" . }}{{ len . | printf "%d" }}`))
+	assert.Empty(t, checkTemplate(t, temp, types.Typ[types.Int]))
+}
+
+func checkTemplate(t *testing.T, temp *template.Template, typ types.Type) []string {
+	var errs []string
+	for _, err := range New(temp).Check([]TranslateInstruction{
+		{"Name", "template.tmpl", typ},
+	}) {
+		errs = append(errs, err.Error())
+	}
+	return errs
+}
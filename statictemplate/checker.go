@@ -0,0 +1,124 @@
+package statictemplate
+
+import (
+	"go/types"
+	"strings"
+	"sync"
+
+	"bou.ke/statictemplate/internal"
+)
+
+// Target is a function generated from a template, with the type of dot as a Go
+// type expression that refers to packages by their full import path, like
+// []bou.ke/statictemplate/example.Post
+type Target struct {
+	FunctionName string
+	TemplateName string
+	Dot          string
+}
+
+// Errors is the list of errors found by a Checker
+type Errors []error
+
+func (e Errors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+// Checker type checks templates against targets whose types are loaded at
+// runtime, the way the command does. The dev output uses it to report the
+// errors the generated code would have whenever the templates are reloaded.
+type Checker struct {
+	Targets []Target
+	// Funcs is a reference to a custom Funcs map in the <import>.<name> format
+	Funcs       string
+	Context     bool
+	PackagePath string
+	// Implementations maps interface types to the concrete types their values
+	// can have, as type expressions like Dot
+	Implementations map[string][]string
+	// BuildFlags are passed on to the go command when loading the packages,
+	// like -tags or -mod
+	BuildFlags []string
+
+	once            sync.Once
+	instructions    []TranslateInstruction
+	funcs           map[string]*types.Func
+	implementations map[types.Type][]types.Type
+	err             error
+}
+
+// Check type checks the template, which is either a *text/template.Template or
+// a *html/template.Template that will be escaped. The packages are loaded the
+// first time it's called. The returned error is of type Errors if the template
+// has type errors.
+func (c *Checker) Check(template interface{}) error {
+	c.once.Do(c.load)
+	if c.err != nil {
+		return c.err
+	}
+	translator := New(template)
+	translator.Funcs = c.funcs
+	translator.Context = c.Context
+	translator.PackagePath = c.PackagePath
+	translator.Implementations = c.implementations
+	if errs := translator.Check(c.instructions); len(errs) != 0 {
+		return Errors(errs)
+	}
+	return nil
+}
+
+func (c *Checker) load() {
+	var paths []string
+	dots := make([]internal.TypeExpr, len(c.Targets))
+	for i, target := range c.Targets {
+		if dots[i], c.err = internal.ParseTypeExpr(target.Dot); c.err != nil {
+			return
+		}
+		paths = append(paths, dots[i].Imports...)
+	}
+	var funcMapImport, funcMapName string
+	if c.Funcs != "" {
+		if funcMapImport, funcMapName, c.err = internal.ParseFuncMapReference(c.Funcs); c.err != nil {
+			return
+		}
+		paths = append(paths, funcMapImport)
+	}
+	implementationPaths, err := internal.Implementations(c.Implementations).Imports()
+	if err != nil {
+		c.err = err
+		return
+	}
+	paths = append(paths, implementationPaths...)
+
+	pkgs, err := internal.Load(c.BuildFlags, paths...)
+	if err != nil {
+		c.err = err
+		return
+	}
+	typesPkgs := make(map[string]*types.Package)
+	for path, pkg := range pkgs {
+		typesPkgs[path] = pkg.Types
+	}
+	for i, target := range c.Targets {
+		typ, err := dots[i].Eval(typesPkgs)
+		if err != nil {
+			c.err = err
+			return
+		}
+		c.instructions = append(c.instructions, TranslateInstruction{
+			FunctionName: target.FunctionName,
+			TemplateName: target.TemplateName,
+			Dot:          typ,
+		})
+	}
+	if c.implementations, c.err = internal.Implementations(c.Implementations).Eval(typesPkgs); c.err != nil {
+		return
+	}
+	if c.Funcs != "" {
+		c.funcs, c.err = internal.FuncMap(pkgs[funcMapImport], funcMapName)
+	}
+}
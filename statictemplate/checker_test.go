@@ -0,0 +1,32 @@
+package statictemplate
+
+import (
+	"html/template"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChecker(t *testing.T) {
+	checker := &Checker{
+		Targets: []Target{
+			{"Name", "template.tmpl", "map[string]int"},
+		},
+	}
+	temp := template.Must(template.New("template.tmpl").Parse(`{{ .a }}{{ .a.b }}{{ range $k, $v := . }}{{ $v.c }}{{ end }}`))
+	err := checker.Check(temp)
+	if assert.IsType(t, Errors{}, err) {
+		assert.EqualError(t, err, "template.tmpl:1:12: unknown field b for type int\ntemplate.tmpl:1:45: unknown field c for type int")
+	}
+
+	assert.NoError(t, checker.Check(template.Must(template.New("template.tmpl").Parse(`{{ .a }}`))))
+}
+
+func TestCheckerInvalidTarget(t *testing.T) {
+	checker := &Checker{
+		Targets: []Target{
+			{"Name", "template.tmpl", "map[string"},
+		},
+	}
+	assert.Error(t, checker.Check(template.Must(template.New("template.tmpl").Parse(`hi`))))
+}
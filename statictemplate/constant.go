@@ -0,0 +1,281 @@
+package statictemplate
+
+import (
+	"bytes"
+	"fmt"
+	"go/types"
+	htmlTemplate "html/template"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	textTemplate "text/template"
+	"text/template/parse"
+)
+
+// constantDot is the value of dot in a template that's called with a constant
+type constantDot struct {
+	value interface{}
+}
+
+// constantOutput returns the output of node if it's the same every time, like
+// text, or an action that prints a constant through functions like html and the
+// escapers of html/template. dot is nil if its value isn't known.
+func (t *Translator) constantOutput(node parse.Node, dot *constantDot, visiting map[string]bool) (string, bool) {
+	switch node := node.(type) {
+	case *parse.ListNode:
+		var output string
+		for _, item := range node.Nodes {
+			text, ok := t.constantOutput(item, dot, visiting)
+			if !ok {
+				return "", false
+			}
+			output += text
+		}
+		return output, true
+	case *parse.TextNode:
+		return string(node.Text), true
+	case *parse.CommentNode:
+		return "", true
+	case *parse.ActionNode:
+		if len(node.Pipe.Decl) != 0 {
+			return "", false
+		}
+		value, ok := t.constantPipe(node.Pipe, dot)
+		if !ok {
+			return "", false
+		}
+		if s, ok := value.(string); ok {
+			return s, true
+		}
+		return fmt.Sprint(value), true
+	case *parse.TemplateNode:
+		// Recursive templates depend on when they stop
+		if visiting[node.Name] {
+			return "", false
+		}
+		var called *constantDot
+		if node.Pipe != nil {
+			value, ok := t.constantPipe(node.Pipe, dot)
+			if !ok {
+				return "", false
+			}
+			called = &constantDot{value}
+		}
+		temp, err := t.template.Lookup(node.Name)
+		if err != nil {
+			return "", false
+		}
+		if visiting == nil {
+			visiting = make(map[string]bool)
+		}
+		visiting[node.Name] = true
+		defer delete(visiting, node.Name)
+		return t.constantOutput(temp.Tree().Root, called, visiting)
+	default:
+		return "", false
+	}
+}
+
+// constantPipe returns the value of pipe if it's a constant
+func (t *Translator) constantPipe(pipe *parse.PipeNode, dot *constantDot) (interface{}, bool) {
+	if len(pipe.Decl) != 0 {
+		return nil, false
+	}
+	var value interface{}
+	for i, cmd := range pipe.Cmds {
+		ident, ok := cmd.Args[0].(*parse.IdentifierNode)
+		// The escapers html/template adds are the last commands
+		if ok && i != 0 && strings.HasPrefix(ident.Ident, "_html_template_") {
+			return escapeConstant(value, pipe.Cmds[i:])
+		}
+		if !ok {
+			// Only functions are passed the result of the previous command
+			if i != 0 || len(cmd.Args) != 1 {
+				return nil, false
+			}
+			if value, ok = t.constantArg(cmd.Args[0], dot); !ok {
+				return nil, false
+			}
+			continue
+		}
+		var args []interface{}
+		for _, arg := range cmd.Args[1:] {
+			arg, ok := t.constantArg(arg, dot)
+			if !ok {
+				return nil, false
+			}
+			args = append(args, arg)
+		}
+		if i != 0 {
+			args = append(args, value)
+		}
+		if value, ok = t.constantCall(ident.Ident, args); !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+func (t *Translator) constantArg(arg parse.Node, dot *constantDot) (interface{}, bool) {
+	switch arg := arg.(type) {
+	case *parse.BoolNode:
+		return arg.True, true
+	case *parse.DotNode:
+		if dot == nil {
+			return nil, false
+		}
+		return dot.value, true
+	case *parse.NumberNode:
+		// The same types text/template gives numbers
+		typ, err := idealConstant(arg)
+		if err != nil {
+			return nil, false
+		}
+		switch typ.Kind() {
+		case types.Int:
+			return int(arg.Int64), true
+		case types.Float64:
+			return arg.Float64, true
+		default:
+			return arg.Complex128, true
+		}
+	case *parse.PipeNode:
+		return t.constantPipe(arg, dot)
+	case *parse.StringNode:
+		return arg.Text, true
+	default:
+		return nil, false
+	}
+}
+
+// constantFuncs are the builtin functions that only depend on their arguments,
+// with the implementations the functions of the funcs package call
+var constantFuncs = map[string]func(...interface{}) string{
+	"html":     textTemplate.HTMLEscaper,
+	"js":       textTemplate.JSEscaper,
+	"urlquery": textTemplate.URLQueryEscaper,
+	"print":    fmt.Sprint,
+	"println":  fmt.Sprintln,
+}
+
+// constantCall calls the builtin function with the given name at generation time
+func (t *Translator) constantCall(name string, args []interface{}) (interface{}, bool) {
+	if _, ok := t.Funcs[name]; ok {
+		return nil, false
+	}
+	if f, ok := constantFuncs[name]; ok {
+		return f(args...), true
+	}
+	if name != "printf" || len(args) == 0 {
+		return nil, false
+	}
+	format, ok := args[0].(string)
+	if !ok {
+		return nil, false
+	}
+	return fmt.Sprintf(format, args[1:]...), true
+}
+
+// escapeContext is the text before and after an action in HTML, whose escapers
+// are applied to a constant by executing the snippet with it
+type escapeContext struct {
+	before, after string
+	template      *htmlTemplate.Template
+}
+
+var escapeContexts = []*escapeContext{
+	{before: "", after: ""},
+	{before: "<textarea>", after: "</textarea>"},
+	{before: `<a title="`, after: `">`},
+	{before: `<a title=`, after: `>`},
+	{before: `<a `, after: `>`},
+	{before: `<a href="`, after: `">`},
+	{before: `<a href="/`, after: `">`},
+	{before: `<a href="/?`, after: `">`},
+	{before: `<a href=`, after: `>`},
+	{before: `<a href=/`, after: `>`},
+	{before: `<a href=/?`, after: `>`},
+	{before: `<a onclick="`, after: `">`},
+	{before: `<a style="`, after: `">`},
+	{before: "<script>", after: "</script>"},
+	{before: `<script>"`, after: `"</script>`},
+	{before: "<script>/", after: "/</script>"},
+	{before: "<style>", after: "</style>"},
+	{before: `<style>"x`, after: `"</style>`},
+}
+
+var (
+	escapersOnce sync.Once
+	// escapers are the escapeContexts by the escapers html/template adds to
+	// their action, which depends on the Go version
+	escapers map[string]*escapeContext
+)
+
+// escapeConstant applies the escapers of html/template in cmds to value
+func escapeConstant(value interface{}, cmds []*parse.CommandNode) (interface{}, bool) {
+	escapersOnce.Do(func() {
+		escapers = make(map[string]*escapeContext)
+		for _, context := range escapeContexts {
+			context.template = htmlTemplate.Must(htmlTemplate.New("").Parse(context.before + "{{.}}" + context.after))
+			if context.template.Execute(ioutil.Discard, "") != nil {
+				continue
+			}
+			for _, node := range context.template.Tree.Root.Nodes {
+				if action, ok := node.(*parse.ActionNode); ok {
+					names := escaperNames(action.Pipe.Cmds[1:])
+					if _, ok := escapers[names]; !ok && names != "" {
+						escapers[names] = context
+					}
+				}
+			}
+		}
+	})
+	context, ok := escapers[escaperNames(cmds)]
+	if !ok {
+		return nil, false
+	}
+	var buf bytes.Buffer
+	if err := context.template.Execute(&buf, value); err != nil {
+		return nil, false
+	}
+	output := buf.String()
+	if len(output) < len(context.before)+len(context.after) || !strings.HasPrefix(output, context.before) || !strings.HasSuffix(output, context.after) {
+		return nil, false
+	}
+	return output[len(context.before) : len(output)-len(context.after)], true
+}
+
+// escaperNames returns the names of the escapers in cmds, or "" if there are other commands
+func escaperNames(cmds []*parse.CommandNode) string {
+	var names []string
+	for _, cmd := range cmds {
+		ident, ok := cmd.Args[0].(*parse.IdentifierNode)
+		if !ok || len(cmd.Args) != 1 || !strings.HasPrefix(ident.Ident, "_html_template_") {
+			return ""
+		}
+		names = append(names, ident.Ident)
+	}
+	return strings.Join(names, " ")
+}
+
+// writeText writes code that writes static text. With StaticBytes, the text is
+// written from a package-level []byte variable.
+func (t *Translator) writeText(w io.Writer, text string) {
+	if text == "" {
+		return
+	}
+	if t.appending || !t.StaticBytes {
+		t.writeString(w, strconv.Quote(text))
+		return
+	}
+	name, ok := t.staticTexts[text]
+	if !ok {
+		name = t.generateFunctionName()
+		t.staticTexts[text] = name
+		t.generatedFunctions = append(t.generatedFunctions, fmt.Sprintf(`
+var %s = []byte(%q)`, name, text))
+	}
+	fmt.Fprintf(w, "_, _ = w.Write(%s)\n", name)
+}
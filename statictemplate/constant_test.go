@@ -0,0 +1,115 @@
+package statictemplate
+
+import (
+	"bytes"
+	"go/types"
+	"html/template"
+	"testing"
+	textTemplate "text/template"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConstantOutput(t *testing.T) {
+	text := `{{define "link"}}<a href="/{{.}}?q={{.}}" title="{{.}}">{{.}}</a>{{end}}<h1>{{ "Tom & Jerry" }}</h1>{{template "link" "a b"}} <p>{{ . }}</p>{{ 1 }}<script>var x = {{ "hi" }};</script>`
+	temp := template.Must(template.New("index.tmpl").Parse(text))
+	actual, err := Translate(temp, "main", []TranslateInstruction{
+		{"Index", "index.tmpl", types.Typ[types.String]},
+	})
+	if assert.NoError(t, err) {
+		equalish(t, `
+package main
+
+import (
+  "bou.ke/statictemplate/funcs"
+  "io"
+)
+
+func Index(w io.Writer, dot string) (err error) {
+  defer func() {
+    if recovered := recover(); recovered != nil {
+      var ok bool
+      if err, ok = recovered.(error); !ok {
+        panic(recovered)
+      }
+    }
+  }()
+  return fun0(w, dot)
+}
+
+// index.tmpl(string)
+func fun0(w io.Writer, dot string) error {
+  _, _ = io.WriteString(w, "<h1>Tom &amp; Jerry</h1><a href=\"/a%20b?q=a%20b\" title=\"a b\">a b</a> <p>")
+  _, _ = io.WriteString(w, funcs.Htmlescaper(dot))
+  _, _ = io.WriteString(w, "</p>1<script>var x = \"hi\";</script>")
+  return nil
+}`, actual, text)
+	}
+
+	// The folded text is what html/template writes
+	var buf bytes.Buffer
+	assert.NoError(t, template.Must(template.New("index.tmpl").Parse(text)).Execute(&buf, ""))
+	assert.Equal(t, `<h1>Tom &amp; Jerry</h1><a href="/a%20b?q=a%20b" title="a b">a b</a> <p></p>1<script>var x = "hi";</script>`, buf.String())
+}
+
+func TestConstantNumbers(t *testing.T) {
+	for _, text := range []string{
+		`{{ printf "%.2f|%T" 2.0 1 }}`,
+		`{{ printf "%T %T %T %T %T %T" 1e3 0x10 'a' 0x1p-2 1i 1_000 }}`,
+		`{{ print 2.0 1e3 }}`,
+		`{{ 1e3 }} {{ 2.50 }} {{ 'a' }}`,
+	} {
+		temp := textTemplate.Must(textTemplate.New("index.tmpl").Parse(text))
+		var buf bytes.Buffer
+		assert.NoError(t, temp.Execute(&buf, nil))
+		output, ok := New(temp).constantOutput(temp.Tree.Root, nil, nil)
+		if assert.True(t, ok, text) {
+			assert.Equal(t, buf.String(), output, text)
+		}
+	}
+}
+
+func TestStaticBytes(t *testing.T) {
+	temp := template.Must(template.New("index.tmpl").Parse(`<p>{{ . }}</p>{{ if . }}</p>{{ end }}`))
+	translator := New(temp)
+	translator.StaticBytes = true
+	actual, err := translator.Translate("main", []TranslateInstruction{
+		{"Index", "index.tmpl", types.Typ[types.String]},
+	})
+	if assert.NoError(t, err) {
+		equalish(t, `
+package main
+
+import (
+  "bou.ke/statictemplate/funcs"
+  "io"
+)
+
+func Index(w io.Writer, dot string) (err error) {
+  defer func() {
+    if recovered := recover(); recovered != nil {
+      var ok bool
+      if err, ok = recovered.(error); !ok {
+        panic(recovered)
+      }
+    }
+  }()
+  return fun0(w, dot)
+}
+
+var fun1 = []byte("<p>")
+
+var fun2 = []byte("</p>")
+
+// index.tmpl(string)
+func fun0(w io.Writer, dot string) error {
+  _, _ = w.Write(fun1)
+  _, _ = io.WriteString(w, funcs.Htmlescaper(dot))
+  _, _ = w.Write(fun2)
+  if eval := dot; len(eval) != 0 {
+    _, _ = w.Write(fun2)
+  }
+  return nil
+}`, actual, "static bytes")
+	}
+}
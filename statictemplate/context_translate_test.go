@@ -0,0 +1,97 @@
+package statictemplate
+
+import (
+	"go/types"
+	"testing"
+	"text/template"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTranslateContext(t *testing.T) {
+	contextPkg := types.NewPackage("context", "context")
+	contextType := types.NewNamed(types.NewTypeName(0, contextPkg, "Context", nil), types.NewInterfaceType(nil, nil), nil)
+	p := types.NewPackage("bou.ke/statictemplate/statictemplate", "statictemplate")
+	translate := types.NewFunc(0, p, "T", types.NewSignature(nil, types.NewTuple(
+		types.NewVar(0, p, "ctx", contextType),
+		types.NewVar(0, p, "key", types.Typ[types.String]),
+	), types.NewTuple(
+		types.NewVar(0, p, "", types.Typ[types.String]),
+	), false))
+
+	temp := template.Must(template.New("template.tmpl").Funcs(template.FuncMap{
+		"t": func(string) string { return "" },
+	}).Parse(`{{ range . }}{{ t . }}{{ end }}{{ template "footer" }}{{ define "footer" }}{{ t "bye" }}{{ end }}`))
+	translator := New(temp)
+	translator.Funcs = map[string]*types.Func{"t": translate}
+	translator.Context = true
+	actual, err := translator.Translate("main", []TranslateInstruction{
+		{"Name", "template.tmpl", types.NewSlice(types.Typ[types.String])},
+	})
+	if assert.NoError(t, err) {
+		equalish(t, `
+package main
+
+import (
+  pkg1 "bou.ke/statictemplate/statictemplate"
+  "context"
+  "io"
+)
+
+func Name(ctx context.Context, w io.Writer, dot []string) (err error) {
+  defer func() {
+    if recovered := recover(); recovered != nil {
+      var ok bool
+      if err, ok = recovered.(error); !ok {
+        panic(recovered)
+      }
+    }
+  }()
+  return fun0(ctx, w, dot)
+}
+
+// footer(nil)
+func fun2(ctx context.Context, w io.Writer, dot interface{}) error {
+  _, _ = io.WriteString(w, pkg1.T(ctx, "bye"))
+  return nil
+}
+
+// template.tmpl([]string)
+func fun0(ctx context.Context, w io.Writer, dot []string) error {
+  if eval := dot; len(eval) != 0 {
+    for _, dot := range eval {
+      _ = dot
+      if err := ctx.Err(); err != nil {
+        return err
+      }
+      _, _ = io.WriteString(w, pkg1.T(ctx, dot))
+    }
+  }
+  if err := fun2(ctx, w, nil); err != nil {
+    return err
+  }
+  return nil
+}`, actual, "")
+	}
+}
+
+func TestTranslateContextRequired(t *testing.T) {
+	contextPkg := types.NewPackage("context", "context")
+	contextType := types.NewNamed(types.NewTypeName(0, contextPkg, "Context", nil), types.NewInterfaceType(nil, nil), nil)
+	p := types.NewPackage("bou.ke/statictemplate/statictemplate", "statictemplate")
+	translate := types.NewFunc(0, p, "T", types.NewSignature(nil, types.NewTuple(
+		types.NewVar(0, p, "ctx", contextType),
+	), types.NewTuple(
+		types.NewVar(0, p, "", types.Typ[types.String]),
+	), false))
+
+	temp := template.Must(template.New("template.tmpl").Funcs(template.FuncMap{
+		"t": func() string { return "" },
+	}).Parse(`{{ t }}`))
+	translator := New(temp)
+	translator.Funcs = map[string]*types.Func{"t": translate}
+	_, err := translator.Translate("main", []TranslateInstruction{
+		{"Name", "template.tmpl", types.Typ[types.String]},
+	})
+	assert.EqualError(t, err, "template.tmpl:1:4: function t takes a context.Context, which requires Context to be enabled")
+}
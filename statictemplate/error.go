@@ -0,0 +1,48 @@
+package statictemplate
+
+import (
+	"errors"
+	"fmt"
+	"text/template/parse"
+
+	"bou.ke/statictemplate/internal"
+)
+
+// Error is an error in a template, with the position of the node it was found at
+type Error struct {
+	// Template is the name the template was parsed with, which is the base
+	// name of the file for templates parsed with ParseFiles or ParseGlob
+	Template string
+	// Line and Column are 1-based, Column is 0 if it isn't known
+	Line, Column int
+	Err          error
+}
+
+func (e *Error) Error() string {
+	if e.Column == 0 {
+		return fmt.Sprintf("%s:%d: %v", e.Template, e.Line, e.Err)
+	}
+	return fmt.Sprintf("%s:%d:%d: %v", e.Template, e.Line, e.Column, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// errInvalid is returned when an expression uses a variable whose declaration
+// failed, so the error isn't reported twice
+var errInvalid = errors.New("use of invalid variable")
+
+// errorAt adds the position of the node to err, unless it already has one
+func (t *Translator) errorAt(node parse.Node, err error) error {
+	if _, ok := err.(*Error); ok || t.tree == nil {
+		return err
+	}
+	name, line, column := internal.Position(t.tree, node)
+	return &Error{
+		Template: name,
+		Line:     line,
+		Column:   column,
+		Err:      err,
+	}
+}
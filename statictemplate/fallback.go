@@ -0,0 +1,334 @@
+package statictemplate
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template/parse"
+
+	"bou.ke/statictemplate/internal"
+	"golang.org/x/tools/go/ast/astutil"
+)
+
+// Fallback is a part of a template that is executed with text/template at
+// runtime, because it couldn't be translated
+type Fallback struct {
+	// Template is the name the part was parsed with, like in Error, and Line
+	// and Column are its position. Column is 0 if it isn't known.
+	Template     string
+	Line, Column int
+	// Node is the part that is executed at runtime, or nil if it's the whole
+	// template with the given Name
+	Node parse.Node
+	Name string
+	// Err is the reason it couldn't be translated
+	Err error
+}
+
+func (f *Fallback) String() string {
+	part := "template " + strconv.Quote(f.Name)
+	if f.Node != nil {
+		part = f.Node.String()
+		if len(part) > 40 {
+			part = part[:37] + "..."
+		}
+	}
+	reason := f.Err
+	if err, ok := reason.(*Error); ok {
+		reason = err.Err
+	}
+	position := fmt.Sprintf("%s:%d", f.Template, f.Line)
+	if f.Column != 0 {
+		position += fmt.Sprintf(":%d", f.Column)
+	}
+	return fmt.Sprintf("%s: executing %s at runtime: %v", position, part, reason)
+}
+
+// fallbackNode writes code that executes node at runtime, with the variables it
+// uses from the translated code. It returns false if that's not possible, like
+// when the node uses $ or assigns to a variable outside of it, or breaks out of
+// or continues a loop around it.
+func (t *Translator) fallbackNode(w io.Writer, node parse.Node, dot types.Type, reason error) bool {
+	// A break or continue in the body of a range in node stays in node
+	inLoop := make(map[parse.Node]bool)
+	walkNodes(node, func(node parse.Node) {
+		if node, ok := node.(*parse.RangeNode); ok {
+			walkNodes(node.List, func(node parse.Node) {
+				inLoop[node] = true
+			})
+		}
+	})
+	names := make(map[string]bool)
+	assigns := make(map[string]bool)
+	var root, loopControl bool
+	walkNodes(node, func(node parse.Node) {
+		switch node := node.(type) {
+		case *parse.BreakNode, *parse.ContinueNode:
+			if !inLoop[node] {
+				loopControl = true
+			}
+		case *parse.VariableNode:
+			if node.Ident[0] == "$" {
+				root = true
+			} else {
+				names[node.Ident[0][1:]] = true
+			}
+		case *parse.PipeNode:
+			for _, decl := range node.Decl {
+				if node.IsAssign {
+					assigns[decl.Ident[0][1:]] = true
+				}
+			}
+		}
+	})
+	if root || loopControl {
+		return false
+	}
+
+	// Variables that are in scope are passed in after dot, the others have to be declared in node
+	var variables []string
+	for name := range names {
+		if typ, err := t.findVariable(name); err == nil && typ != types.Typ[types.Invalid] {
+			if assigns[name] {
+				return false
+			}
+			variables = append(variables, name)
+		}
+	}
+	sort.Strings(variables)
+	var text, args strings.Builder
+	args.WriteString("dot")
+	for i, name := range variables {
+		fmt.Fprintf(&text, "{{$%s := index . %d}}", name, i+1)
+		fmt.Fprintf(&args, ", %s%s", varPrefix, name)
+	}
+	// Ranging over a slice with dot in it sets dot, even if it's empty
+	fmt.Fprintf(&text, "{{range slice . 0 1}}%s{{end}}", node)
+
+	name, ok := t.generateFallbackTemplate(node, text.String())
+	if !ok {
+		return false
+	}
+	if t.appending {
+		fmt.Fprintf(w, "if err := %s.Execute((*%s)(w), []interface{}{%s}); err != nil {\nreturn err\n}\n", name, t.generateAppendWriter(), args.String())
+		// The part is reported when generating the functions that write to an io.Writer
+		return true
+	}
+	fmt.Fprintf(w, "if err := %s.Execute(w, []interface{}{%s}); err != nil {\nreturn err\n}\n", name, args.String())
+	fallback := &Fallback{Node: node, Err: reason}
+	fallback.Template, fallback.Line, fallback.Column = internal.Position(t.tree, node)
+	t.Fallbacks = append(t.Fallbacks, fallback)
+	return true
+}
+
+// fallbackTemplate writes the body of a function that executes the whole template at runtime
+func (t *Translator) fallbackTemplate(w io.Writer, temp wrappedTemplate, reason error) bool {
+	call := &parse.TemplateNode{NodeType: parse.NodeTemplate, Name: temp.Name()}
+	name, ok := t.generateFallbackTemplate(call, fmt.Sprintf("{{template %q .}}", temp.Name()))
+	if !ok {
+		return false
+	}
+	if t.appending {
+		fmt.Fprintf(w, "return %s.ExecuteTemplate((*%s)(w), %q, dot)\n", name, t.generateAppendWriter(), temp.Name())
+		return true
+	}
+	fmt.Fprintf(w, "return %s.ExecuteTemplate(w, %q, dot)\n", name, temp.Name())
+	fallback := &Fallback{Template: temp.Tree().ParseName, Line: 1, Name: temp.Name(), Err: reason}
+	if err, ok := reason.(*Error); ok {
+		fallback.Template, fallback.Line, fallback.Column = err.Template, err.Line, err.Column
+	}
+	t.Fallbacks = append(t.Fallbacks, fallback)
+	return true
+}
+
+// generateFallbackTemplate generates a variable with a text/template parsed from
+// text, which has the templates node calls defined in it. Templates are parsed
+// from their String, so it checks they parse back to the same tree, which isn't
+// the case if their text has delimiters in it.
+func (t *Translator) generateFallbackTemplate(node parse.Node, text string) (string, bool) {
+	texts := map[string]string{"": text}
+	var names []string
+	var funcs []string
+	var err error
+	var walk func(parse.Node)
+	walk = func(node parse.Node) {
+		walkNodes(node, func(node parse.Node) {
+			switch node := node.(type) {
+			case *parse.IdentifierNode:
+				funcs = append(funcs, node.Ident)
+			case *parse.TemplateNode:
+				if _, ok := texts[node.Name]; ok {
+					return
+				}
+				temp, lookupErr := t.template.Lookup(node.Name)
+				if lookupErr != nil {
+					err = lookupErr
+					return
+				}
+				texts[node.Name] = temp.Tree().Root.String()
+				names = append(names, node.Name)
+				walk(temp.Tree().Root)
+			}
+		})
+	}
+	walk(node)
+	if err != nil {
+		return "", false
+	}
+
+	var full strings.Builder
+	full.WriteString(text)
+	for _, name := range names {
+		fmt.Fprintf(&full, "{{define %q}}%s{{end}}", name, texts[name])
+	}
+	tree := parse.New("")
+	tree.Mode = parse.SkipFuncCheck
+	trees := make(map[string]*parse.Tree)
+	if _, err := tree.Parse(full.String(), "", "", trees); err != nil {
+		return "", false
+	}
+	for name, text := range texts {
+		if trees[name] == nil || trees[name].Root.String() != text {
+			return "", false
+		}
+	}
+
+	// text/template has the builtin functions, but not the escapers html/template adds
+	var funcMap bytes.Buffer
+	seen := make(map[string]bool)
+	for _, ident := range funcs {
+		if seen[ident] {
+			continue
+		}
+		seen[ident] = true
+		if f, ok := t.Funcs[ident]; ok {
+			if internal.TakesContext(f.Type().(*types.Signature)) {
+				return "", false
+			}
+			fmt.Fprintf(&funcMap, "%q: %s%s,\n", ident, t.qualify(f.Pkg()), f.Name())
+		} else if f, ok := t.builtins[ident]; ok && strings.HasPrefix(ident, "_html_template_") {
+			fmt.Fprintf(&funcMap, "%q: %s%s,\n", ident, t.qualify(f.Pkg()), f.Name())
+		} else if !ok && ident != "slice" {
+			return "", false
+		}
+	}
+
+	if name, ok := t.fallbackTemplates[full.String()]; ok {
+		return name, true
+	}
+	name := t.generateFunctionName()
+	t.fallbackTemplates[full.String()] = name
+	pkg := t.importPackage("text/template")
+	var options string
+	if funcMap.Len() != 0 {
+		options = fmt.Sprintf(".Funcs(%s.FuncMap{\n%s})", pkg, funcMap.String())
+	}
+	// Missing keys give the zero value like in the translated code, instead of <no value>
+	missingKey := "zero"
+	if t.MissingKey == "error" {
+		missingKey = "error"
+	}
+	options += fmt.Sprintf(`.Option("missingkey=%s")`, missingKey)
+	t.generatedFunctions = append(t.generatedFunctions, fmt.Sprintf(`
+var %s = %s.Must(%s.New("")%s.Parse(%q))`, name, pkg, pkg, options, full.String()))
+	return name, true
+}
+
+// generateAppendWriter generates an io.Writer that appends to a []byte, for the
+// parts that are executed at runtime in functions that append
+func (t *Translator) generateAppendWriter() string {
+	if t.appendWriter == "" {
+		t.appendWriter = t.generateFunctionName()
+		t.generatedFunctions = append(t.generatedFunctions, fmt.Sprintf(`
+type %s []byte
+
+func (w *%s) Write(p []byte) (int, error) {
+	*w = append(*w, p...)
+	return len(p), nil
+}`, t.appendWriter, t.appendWriter))
+	}
+	return t.appendWriter
+}
+
+// walkNodes calls fn for node and every node in it, not following template calls
+func walkNodes(node parse.Node, fn func(parse.Node)) {
+	if node == nil {
+		return
+	}
+	fn(node)
+	switch node := node.(type) {
+	case *parse.ListNode:
+		for _, item := range node.Nodes {
+			walkNodes(item, fn)
+		}
+	case *parse.ActionNode:
+		walkNodes(node.Pipe, fn)
+	case *parse.IfNode:
+		walkBranch(&node.BranchNode, fn)
+	case *parse.RangeNode:
+		walkBranch(&node.BranchNode, fn)
+	case *parse.WithNode:
+		walkBranch(&node.BranchNode, fn)
+	case *parse.TemplateNode:
+		if node.Pipe != nil {
+			walkNodes(node.Pipe, fn)
+		}
+	case *parse.PipeNode:
+		for _, decl := range node.Decl {
+			walkNodes(decl, fn)
+		}
+		for _, cmd := range node.Cmds {
+			walkNodes(cmd, fn)
+		}
+	case *parse.CommandNode:
+		for _, arg := range node.Args {
+			walkNodes(arg, fn)
+		}
+	case *parse.ChainNode:
+		walkNodes(node.Node, fn)
+	}
+}
+
+func walkBranch(node *parse.BranchNode, fn func(parse.Node)) {
+	walkNodes(node.Pipe, fn)
+	if node.List != nil {
+		walkNodes(node.List, fn)
+	}
+	if node.ElseList != nil {
+		walkNodes(node.ElseList, fn)
+	}
+}
+
+// removeUnusedImports removes the imports that are only used by code that was
+// discarded because it was executed at runtime instead
+func removeUnusedImports(src []byte) ([]byte, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "", src, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	// DeleteNamedImport changes file.Imports
+	for _, spec := range append([]*ast.ImportSpec(nil), file.Imports...) {
+		path, _ := strconv.Unquote(spec.Path.Value)
+		if !astutil.UsesImport(file, path) {
+			var name string
+			if spec.Name != nil {
+				name = spec.Name.Name
+			}
+			astutil.DeleteNamedImport(fset, file, name, path)
+		}
+	}
+	var buf bytes.Buffer
+	if err := format.Node(&buf, fset, file); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
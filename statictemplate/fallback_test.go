@@ -0,0 +1,94 @@
+package statictemplate
+
+import (
+	"go/types"
+	"testing"
+	"text/template"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFallback(t *testing.T) {
+	temp := template.Must(template.New("index.tmpl").Parse(`{{ $n := "items" }}{{ range . }}{{ printf "%s %s" (slice $n 1) $n }}{{ end }}{{ template "first.tmpl" . }}{{ define "first.tmpl" }}{{ range . }}{{ $ }}{{ end }}{{ end }}`))
+	instructions := []TranslateInstruction{
+		{"Index", "index.tmpl", types.NewSlice(types.Typ[types.String])},
+	}
+	_, err := Translate(temp, "main", instructions)
+	assert.EqualError(t, err, "index.tmpl:1:52: unknown function slice")
+
+	translator := New(temp)
+	translator.Fallback = true
+	actual, err := translator.Translate("main", instructions)
+	if !assert.NoError(t, err) {
+		return
+	}
+	equalish(t, `
+package main
+
+import (
+  "io"
+  "text/template"
+)
+
+func Index(w io.Writer, dot []string) (err error) {
+  defer func() {
+    if recovered := recover(); recovered != nil {
+      var ok bool
+      if err, ok = recovered.(error); !ok {
+        panic(recovered)
+      }
+    }
+  }()
+  return fun0(w, dot)
+}
+
+var fun1 = template.Must(template.New("").Option("missingkey=zero").Parse("{{$n := index . 1}}{{range slice . 0 1}}{{printf \"%s %s\" (slice $n 1) $n}}{{end}}"))
+
+var fun3 = template.Must(template.New("").Option("missingkey=zero").Parse("{{template \"first.tmpl\" .}}{{define \"first.tmpl\"}}{{range .}}{{$}}{{end}}{{end}}"))
+
+// first.tmpl([]string)
+func fun2(w io.Writer, dot []string) error {
+  return fun3.ExecuteTemplate(w, "first.tmpl", dot)
+}
+
+// index.tmpl([]string)
+func fun0(w io.Writer, dot []string) error {
+  _Varn := "items"
+  _ = _Varn
+  if eval := dot; len(eval) != 0 {
+    for _, dot := range eval {
+      _ = dot
+      if err := fun1.Execute(w, []interface{}{dot, _Varn}); err != nil {
+        return err
+      }
+    }
+  }
+  if err := fun2(w, dot); err != nil {
+    return err
+  }
+  return nil
+}`, actual, "fallback")
+
+	if assert.Len(t, translator.Fallbacks, 2) {
+		assert.Equal(t, `index.tmpl:1:36: executing {{printf "%s %s" (slice $n 1) $n}} at runtime: unknown function slice`, translator.Fallbacks[0].String())
+		assert.Equal(t, `index.tmpl:1:148: executing template "first.tmpl" at runtime: can't find variable $ in scope`, translator.Fallbacks[1].String())
+	}
+}
+
+func TestFallbackLoopControl(t *testing.T) {
+	temp := template.Must(template.New("index.tmpl").Parse(`{{ range . }}{{ if eq (slice "ab" 1) "b" }}{{ if eq . 2 }}{{ break }}{{ end }}{{ end }}{{ . }}{{ end }}`))
+	instructions := []TranslateInstruction{
+		{"Index", "index.tmpl", types.NewSlice(types.Typ[types.Int])},
+	}
+	translator := New(temp)
+	translator.Fallback = true
+	actual, err := translator.Translate("main", instructions)
+	if !assert.NoError(t, err) {
+		return
+	}
+	// The break has to stay in the range it breaks out of
+	assert.Contains(t, string(actual), `Parse("{{range slice . 0 1}}{{range .}}{{if eq (slice \"ab\" 1) \"b\"}}{{if eq . 2}}{{break}}{{end}}{{end}}{{.}}{{end}}{{end}}")`)
+	if assert.Len(t, translator.Fallbacks, 1) {
+		assert.Equal(t, `index.tmpl:1:10: executing {{range .}}{{if eq (slice "ab" 1) "b"... at runtime: unknown function slice`, translator.Fallbacks[0].String())
+	}
+}
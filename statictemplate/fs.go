@@ -0,0 +1,40 @@
+package statictemplate
+
+import (
+	"fmt"
+	"io/fs"
+)
+
+// ParseFS parses the files in fsys matching the patterns into template, which is
+// either a *text/template.Template or a *html/template.Template. Unlike ParseFS of
+// those packages, every file is named by its path in fsys, like admin/index.tmpl,
+// so files with the same base name in different directories don't collide.
+func ParseFS(template interface{}, fsys fs.FS, patterns ...string) error {
+	return ParseOptions{}.ParseFS(template, fsys, patterns...)
+}
+
+// ParseFS is like the ParseFS function, but parses with the options
+func (o ParseOptions) ParseFS(template interface{}, fsys fs.FS, patterns ...string) error {
+	var names []string
+	for _, pattern := range patterns {
+		matches, err := fs.Glob(fsys, pattern)
+		if err != nil {
+			return err
+		}
+		if len(matches) == 0 {
+			return fmt.Errorf("template: pattern matches no files: %#q", pattern)
+		}
+		names = append(names, matches...)
+	}
+
+	for _, name := range names {
+		contents, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		if err := o.Parse(template, name, string(contents)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package statictemplate
+
+import (
+	"go/types"
+	"testing"
+	"testing/fstest"
+	"text/template"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"index.tmpl":       {Data: []byte(`public {{ template "admin/index.tmpl" . }}`)},
+		"admin/index.tmpl": {Data: []byte(`admin {{ . }}`)},
+	}
+	temp := template.New("")
+	if !assert.NoError(t, ParseFS(temp, fsys, "*.tmpl", "admin/*.tmpl")) {
+		return
+	}
+	assert.NotNil(t, temp.Lookup("index.tmpl"))
+	assert.NotNil(t, temp.Lookup("admin/index.tmpl"))
+
+	actual, err := Translate(temp, "main", []TranslateInstruction{
+		{"Index", "index.tmpl", types.Typ[types.String]},
+	})
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(actual), `// admin/index.tmpl(string)`)
+	}
+
+	assert.EqualError(t, ParseFS(template.New(""), fsys, "missing/*.tmpl"), "template: pattern matches no files: `missing/*.tmpl`")
+}
@@ -0,0 +1,219 @@
+package statictemplate
+
+import (
+	"go/types"
+	"html/template"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandlers(t *testing.T) {
+	temp := template.Must(template.New("index.tmpl").Parse(`<p>{{ . }}</p>`))
+	translator := New(temp)
+	translator.Handlers = true
+	translator.Sizes = true
+	actual, err := translator.Translate("main", []TranslateInstruction{
+		{"Index", "index.tmpl", types.Typ[types.String]},
+	})
+	if assert.NoError(t, err) {
+		equalish(t, `
+package main
+
+import (
+  "bou.ke/statictemplate/funcs"
+  "bytes"
+  "errors"
+  "hash/fnv"
+  "io"
+  "net/http"
+  "strconv"
+  "time"
+)
+
+func Index(w io.Writer, dot string) (err error) {
+  defer func() {
+    if recovered := recover(); recovered != nil {
+      var ok bool
+      if err, ok = recovered.(error); !ok {
+        panic(recovered)
+      }
+    }
+  }()
+  return fun0(w, dot)
+}
+
+const IndexMinSize = 7
+
+// IndexHandler returns an http.Handler that serves the output of Index, with the
+// dot load returns for the request. Errors are passed to fail, or answered
+// with the status of their StatusCode method, or a 500, when fail is nil.
+func IndexHandler(load func(*http.Request) (string, error), fail func(http.ResponseWriter, *http.Request, error)) http.Handler {
+  if fail == nil {
+    fail = func(w http.ResponseWriter, r *http.Request, err error) {
+      code := http.StatusInternalServerError
+      var status interface{ StatusCode() int }
+      if errors.As(err, &status) {
+        code = status.StatusCode()
+      }
+      http.Error(w, http.StatusText(code), code)
+    }
+  }
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    dot, err := load(r)
+    if err != nil {
+      fail(w, r, err)
+      return
+    }
+    var buf bytes.Buffer
+    buf.Grow(IndexMinSize)
+    if err := Index(&buf, dot); err != nil {
+      fail(w, r, err)
+      return
+    }
+    hash := fnv.New64a()
+    _, _ = hash.Write(buf.Bytes())
+    w.Header().Set("Content-Type", "text/html; charset=utf-8")
+    w.Header().Set("ETag", "\""+strconv.FormatUint(hash.Sum64(), 36)+"\"")
+    http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(buf.Bytes()))
+  })
+}
+
+// index.tmpl(string)
+func fun0(w io.Writer, dot string) error {
+  _, _ = io.WriteString(w, "<p>")
+  _, _ = io.WriteString(w, funcs.Htmlescaper(dot))
+  _, _ = io.WriteString(w, "</p>")
+  return nil
+}`, actual, "handlers")
+	}
+}
+
+func TestHandlersBuffered(t *testing.T) {
+	temp := template.Must(template.New("index.tmpl").Parse(`<p>{{ . }}</p>`))
+	translator := New(temp)
+	translator.Handlers = true
+	translator.Buffered = true
+	actual, err := translator.Translate("main", []TranslateInstruction{
+		{"Index", "index.tmpl", types.Typ[types.String]},
+	})
+	if assert.NoError(t, err) {
+		equalish(t, `
+package main
+
+import (
+  "bou.ke/statictemplate/funcs"
+  "bytes"
+  "errors"
+  "hash/fnv"
+  "io"
+  "net/http"
+  "strconv"
+  "sync"
+  "sync/atomic"
+  "time"
+)
+
+func Index(w io.Writer, dot string) error {
+  buf, err := fun3(dot)
+  if err != nil {
+    return err
+  }
+  defer fun2.put(buf)
+  _, err = w.Write(buf.Bytes())
+  return err
+}
+
+// fun3 renders Index into a buffer from fun2, which the caller puts back
+func fun3(dot string) (buf *bytes.Buffer, err error) {
+  defer func() {
+    if recovered := recover(); recovered != nil {
+      var ok bool
+      if err, ok = recovered.(error); !ok {
+        panic(recovered)
+      }
+    }
+  }()
+  buf = fun2.get()
+  if err = fun0(buf, dot); err != nil {
+    fun2.put(buf)
+    return nil, err
+  }
+  fun2.observe(buf.Len())
+  return buf, nil
+}
+
+// IndexHandler returns an http.Handler that serves the output of Index, with the
+// dot load returns for the request. Errors are passed to fail, or answered
+// with the status of their StatusCode method, or a 500, when fail is nil.
+func IndexHandler(load func(*http.Request) (string, error), fail func(http.ResponseWriter, *http.Request, error)) http.Handler {
+  if fail == nil {
+    fail = func(w http.ResponseWriter, r *http.Request, err error) {
+      code := http.StatusInternalServerError
+      var status interface{ StatusCode() int }
+      if errors.As(err, &status) {
+        code = status.StatusCode()
+      }
+      http.Error(w, http.StatusText(code), code)
+    }
+  }
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    dot, err := load(r)
+    if err != nil {
+      fail(w, r, err)
+      return
+    }
+    buf, err := fun3(dot)
+    if err != nil {
+      fail(w, r, err)
+      return
+    }
+    defer fun2.put(buf)
+    hash := fnv.New64a()
+    _, _ = hash.Write(buf.Bytes())
+    w.Header().Set("Content-Type", "text/html; charset=utf-8")
+    w.Header().Set("ETag", "\""+strconv.FormatUint(hash.Sum64(), 36)+"\"")
+    http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(buf.Bytes()))
+  })
+}
+
+// index.tmpl(string)
+func fun0(w io.Writer, dot string) error {
+  _, _ = io.WriteString(w, "<p>")
+  _, _ = io.WriteString(w, funcs.Htmlescaper(dot))
+  _, _ = io.WriteString(w, "</p>")
+  return nil
+}
+
+// fun1 is a pool of buffers, whose new buffers are as big as the moving average of the output
+type fun1 struct {
+  // size is first, to be aligned for atomic operations
+  size int64
+  pool sync.Pool
+}
+
+func (p *fun1) get() *bytes.Buffer {
+  if buf, ok := p.pool.Get().(*bytes.Buffer); ok {
+    return buf
+  }
+  return bytes.NewBuffer(make([]byte, 0, atomic.LoadInt64(&p.size)))
+}
+
+// observe moves the size of new buffers an eighth of the way to the size of an output
+func (p *fun1) observe(size int) {
+  old := atomic.LoadInt64(&p.size)
+  if average := old + (int64(size)-old)/8; average != old {
+    atomic.StoreInt64(&p.size, average)
+  }
+}
+
+func (p *fun1) put(buf *bytes.Buffer) {
+  if buf.Cap() <= 1<<20 {
+    buf.Reset()
+    p.pool.Put(buf)
+  }
+}
+
+var fun2 fun1`, actual, "handlers with buffers")
+	}
+}
@@ -1,8 +1,8 @@
 package statictemplate
 
 import (
+	"github.com/stretchr/testify/assert"
 	"go/types"
-	"gopkg.in/stretchr/testify.v1/assert"
 	"html/template"
 	"testing"
 )
@@ -0,0 +1,110 @@
+package statictemplate
+
+import (
+	"go/types"
+	"testing"
+	"text/template"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInline(t *testing.T) {
+	p := types.NewPackage("bou.ke/menus", "menus")
+	item := types.NewNamed(types.NewTypeName(0, p, "Item", nil), nil, nil)
+	item.SetUnderlying(types.NewStruct([]*types.Var{
+		types.NewVar(0, p, "Name", types.Typ[types.String]),
+		types.NewVar(0, p, "Children", types.NewSlice(item)),
+	}, nil))
+	temp := template.Must(template.New("index.tmpl").Parse(`{{define "name"}}{{ $x := .Name }}<b>{{ $x }}</b>{{end}}{{define "item"}}<li>{{ template "name" . }}{{ range .Children }}{{ template "item" . }}{{ end }}</li>{{end}}{{ $x := 1 }}{{ range . }}{{ template "item" . }}{{ end }}{{ $x }}`))
+	translator := New(temp)
+	translator.Inline = 30
+	actual, err := translator.Translate("main", []TranslateInstruction{
+		{"Index", "index.tmpl", types.NewSlice(item)},
+	})
+	if assert.NoError(t, err) {
+		equalish(t, `
+package main
+
+import (
+  pkg1 "bou.ke/menus"
+  "io"
+  "strconv"
+)
+
+func Index(w io.Writer, dot []pkg1.Item) (err error) {
+  defer func() {
+    if recovered := recover(); recovered != nil {
+      var ok bool
+      if err, ok = recovered.(error); !ok {
+        panic(recovered)
+      }
+    }
+  }()
+  return fun0(w, dot)
+}
+
+// item(pkg1.Item)
+func fun2(w io.Writer, dot pkg1.Item) error {
+  _, _ = io.WriteString(w, "<li>")
+  // name(pkg1.Item), inlined
+  {
+    var dot pkg1.Item = dot
+    _ = dot
+    _Varx := dot.Name
+    _ = _Varx
+    _, _ = io.WriteString(w, "<b>")
+    _, _ = io.WriteString(w, _Varx)
+    _, _ = io.WriteString(w, "</b>")
+  }
+  if eval := dot.Children; len(eval) != 0 {
+    for _, dot := range eval {
+      _ = dot
+      if err := fun2(w, dot); err != nil {
+        return err
+      }
+    }
+  }
+  _, _ = io.WriteString(w, "</li>")
+  return nil
+}
+
+// index.tmpl([]pkg1.Item)
+func fun0(w io.Writer, dot []pkg1.Item) error {
+  var scratch [32]byte
+  _Varx := 1
+  _ = _Varx
+  if eval := dot; len(eval) != 0 {
+    for _, dot := range eval {
+      _ = dot
+      // item(pkg1.Item), inlined
+      {
+        var dot pkg1.Item = dot
+        _ = dot
+        _, _ = io.WriteString(w, "<li>")
+        // name(pkg1.Item), inlined
+        {
+          var dot pkg1.Item = dot
+          _ = dot
+          _Varx := dot.Name
+          _ = _Varx
+          _, _ = io.WriteString(w, "<b>")
+          _, _ = io.WriteString(w, _Varx)
+          _, _ = io.WriteString(w, "</b>")
+        }
+        if eval := dot.Children; len(eval) != 0 {
+          for _, dot := range eval {
+            _ = dot
+            if err := fun2(w, dot); err != nil {
+              return err
+            }
+          }
+        }
+        _, _ = io.WriteString(w, "</li>")
+      }
+    }
+  }
+  _, _ = w.Write(strconv.AppendInt(scratch[:0], int64(_Varx), 10))
+  return nil
+}`, actual, "inline")
+	}
+}
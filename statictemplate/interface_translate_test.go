@@ -0,0 +1,95 @@
+package statictemplate
+
+import (
+	"go/types"
+	"testing"
+	"text/template"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTranslateImplementations(t *testing.T) {
+	p := types.NewPackage("bou.ke/widgets", "widgets")
+	name := types.NewVar(0, p, "Name", types.Typ[types.String])
+	chartStruct := types.NewStruct([]*types.Var{name}, nil)
+	chart := types.NewNamed(types.NewTypeName(0, p, "Chart", nil), chartStruct, nil)
+	tableStruct := types.NewStruct([]*types.Var{name, types.NewVar(0, p, "Rows", types.Typ[types.Int])}, nil)
+	table := types.NewNamed(types.NewTypeName(0, p, "Table", nil), tableStruct, nil)
+	empty := types.NewInterfaceType(nil, nil)
+
+	temp := template.Must(template.New("sidebar.tmpl").Parse(`{{ range . }}{{ template "widget" . }}{{ end }}{{ define "widget" }}{{ .Name }}{{ end }}`))
+	translator := New(temp)
+	translator.Implementations = map[types.Type][]types.Type{
+		types.NewInterfaceType(nil, nil): {chart, types.NewPointer(table)},
+	}
+	actual, err := translator.Translate("main", []TranslateInstruction{
+		{"Sidebar", "sidebar.tmpl", types.NewSlice(empty)},
+	})
+	if assert.NoError(t, err) {
+		equalish(t, `
+package main
+
+import (
+  pkg3 "bou.ke/widgets"
+  "fmt"
+  "io"
+)
+
+func Sidebar(w io.Writer, dot []interface{}) (err error) {
+  defer func() {
+    if recovered := recover(); recovered != nil {
+      var ok bool
+      if err, ok = recovered.(error); !ok {
+        panic(recovered)
+      }
+    }
+  }()
+  return fun0(w, dot)
+}
+
+// widget(pkg3.Chart)
+func fun2(w io.Writer, dot pkg3.Chart) error {
+  _, _ = io.WriteString(w, dot.Name)
+  return nil
+}
+
+// widget(*pkg3.Table)
+func fun4(w io.Writer, dot *pkg3.Table) error {
+  _, _ = io.WriteString(w, dot.Name)
+  return nil
+}
+
+// widget(interface{})
+func fun1(w io.Writer, dot interface{}) error {
+  switch dot := dot.(type) {
+  case pkg3.Chart:
+    return fun2(w, dot)
+  case *pkg3.Table:
+    return fun4(w, dot)
+  }
+  return fmt.Errorf("template: %s: %T isn't a listed implementation of %s", "widget", dot, "interface{}")
+}
+
+// sidebar.tmpl([]interface{})
+func fun0(w io.Writer, dot []interface{}) error {
+  if eval := dot; len(eval) != 0 {
+    for _, dot := range eval {
+      _ = dot
+      if err := fun1(w, dot); err != nil {
+        return err
+      }
+    }
+  }
+  return nil
+}`, actual, "implementations")
+	}
+
+	translator = New(temp)
+	translator.Implementations = map[types.Type][]types.Type{
+		empty: {chart, empty},
+	}
+	_, err = translator.Translate("main", []TranslateInstruction{
+		{"Sidebar", "sidebar.tmpl", types.NewSlice(empty)},
+	})
+	assert.EqualError(t, err, "sidebar.tmpl:1:26: implementation interface{} of interface{} isn't a concrete type")
+}
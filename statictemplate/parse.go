@@ -0,0 +1,95 @@
+package statictemplate
+
+import (
+	"fmt"
+	htmlTemplate "html/template"
+	"io/ioutil"
+	"path/filepath"
+	textTemplate "text/template"
+	"text/template/parse"
+)
+
+// ParseOptions are options for parsing templates that can't be read back from a
+// *text/template.Template or *html/template.Template, or that they have no setter
+// for. The command and the dev output it generates parse templates with them, so
+// both builds parse identically.
+type ParseOptions struct {
+	// LeftDelim and RightDelim are the action delimiters, {{ and }} if empty
+	LeftDelim, RightDelim string
+	// Mode is the mode of the parser, like parse.ParseComments or parse.SkipFuncCheck
+	Mode parse.Mode
+}
+
+// Parse parses text as the template with the given name, and associates it
+// with template, which is either a *text/template.Template or a
+// *html/template.Template
+func (o ParseOptions) Parse(template interface{}, name, text string) error {
+	if o.Mode&parse.SkipFuncCheck == 0 {
+		// Parse the template the usual way first, to check the functions with the ones of the template
+		var err error
+		switch t := template.(type) {
+		case *textTemplate.Template:
+			if name != t.Name() {
+				t = t.New(name)
+			}
+			_, err = t.Delims(o.LeftDelim, o.RightDelim).Parse(text)
+		case *htmlTemplate.Template:
+			if name != t.Name() {
+				t = t.New(name)
+			}
+			_, err = t.Delims(o.LeftDelim, o.RightDelim).Parse(text)
+		default:
+			panic("invalid template passed in")
+		}
+		if err != nil || o.Mode == 0 {
+			return err
+		}
+	}
+
+	tree := parse.New(name)
+	tree.Mode = o.Mode | parse.SkipFuncCheck
+	treeSet := make(map[string]*parse.Tree)
+	if _, err := tree.Parse(text, o.LeftDelim, o.RightDelim, treeSet); err != nil {
+		return err
+	}
+	for name, tree := range treeSet {
+		var err error
+		switch t := template.(type) {
+		case *textTemplate.Template:
+			// Like Parse, an empty template doesn't replace an existing one
+			if existing := t.Lookup(name); existing != nil && existing.Tree != nil && parse.IsEmptyTree(tree.Root) {
+				continue
+			}
+			_, err = t.AddParseTree(name, tree)
+		case *htmlTemplate.Template:
+			if existing := t.Lookup(name); existing != nil && existing.Tree != nil && parse.IsEmptyTree(tree.Root) {
+				continue
+			}
+			_, err = t.AddParseTree(name, tree)
+		default:
+			panic("invalid template passed in")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ParseFiles parses the files into template like the ParseFiles of
+// text/template and html/template, naming them by their base name
+func (o ParseOptions) ParseFiles(template interface{}, files ...string) error {
+	if len(files) == 0 {
+		return fmt.Errorf("template: no files named in call to ParseFiles")
+	}
+	for _, file := range files {
+		contents, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if err := o.Parse(template, filepath.Base(file), string(contents)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package statictemplate
+
+import (
+	"go/types"
+	"html/template"
+	"testing"
+	"text/template/parse"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseOptions(t *testing.T) {
+	options := ParseOptions{LeftDelim: "[[", RightDelim: "]]", Mode: parse.ParseComments}
+	temp := template.New("")
+	if !assert.NoError(t, options.Parse(temp, "index.tmpl", `[[/* comment */]]{{ [[ . ]] }}`)) {
+		return
+	}
+	_, ok := temp.Lookup("index.tmpl").Tree.Root.Nodes[0].(*parse.CommentNode)
+	assert.True(t, ok)
+
+	actual, err := Translate(temp, "main", []TranslateInstruction{
+		{"Index", "index.tmpl", types.Typ[types.String]},
+	})
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(actual), `_, _ = io.WriteString(w, "{{ ")`)
+	}
+
+	// Functions are checked unless the mode skips the check
+	assert.EqualError(t, options.Parse(template.New(""), "index.tmpl", `[[ missing ]]`), `template: index.tmpl:1: function "missing" not defined`)
+	options.Mode |= parse.SkipFuncCheck
+	assert.NoError(t, options.Parse(template.New(""), "index.tmpl", `[[ missing ]]`))
+}
@@ -0,0 +1,126 @@
+package statictemplate
+
+import (
+	"fmt"
+	"go/token"
+	"go/types"
+	"io"
+)
+
+var (
+	errorInterface    = types.Universe.Lookup("error").Type().Underlying().(*types.Interface)
+	stringerInterface = types.NewInterfaceType([]*types.Func{
+		types.NewFunc(token.NoPos, nil, "String", types.NewSignature(nil, nil, types.NewTuple(types.NewVar(token.NoPos, nil, "", types.Typ[types.String])), false)),
+	}, nil).Complete()
+)
+
+// writePrint writes code that prints value, which has type typ, the way
+// fmt.Fprint does. Errors and Stringers have their method called, and basic
+// types are formatted with strconv, without boxing them in an interface{}.
+// Other values, and the ones that format themselves, are printed with fmt.
+func (t *Translator) writePrint(w io.Writer, typ types.Type, value string) {
+	if typeIsNil(typ) || types.IsInterface(typ) || hasMethod(typ, "Format") {
+		t.writeFmtPrint(w, value)
+		return
+	}
+	var method string
+	if types.Implements(typ, errorInterface) {
+		method = "Error"
+	} else if types.Implements(typ, stringerInterface) {
+		method = "String"
+	}
+	if method != "" {
+		if _, ok := typ.Underlying().(*types.Pointer); ok {
+			// Like fmt, the method is called on nil pointers too, and they're printed
+			// as <nil> if it panics
+			fmt.Fprintf(w, "if eval := %s; eval != nil {\n", value)
+			t.writeString(w, "eval."+method+"()")
+			io.WriteString(w, "} else {\n")
+			t.writeString(w, `func() (s string) {
+  defer func() {
+    if recover() != nil {
+      s = "<nil>"
+    }
+  }()
+  return eval.`+method+`()
+}()`)
+			io.WriteString(w, "}\n")
+		} else {
+			t.writeString(w, value+"."+method+"()")
+		}
+		return
+	}
+
+	basic, ok := typ.Underlying().(*types.Basic)
+	if !ok || basic.Info()&types.IsUntyped != 0 {
+		t.writeFmtPrint(w, value)
+		return
+	}
+	info := basic.Info()
+	switch {
+	case info&types.IsString != 0:
+		t.writeString(w, convert(typ, types.Typ[types.String], value))
+	case info&types.IsBoolean != 0:
+		fmt.Fprintf(w, "if %s {\n", value)
+		t.writeString(w, `"true"`)
+		io.WriteString(w, "} else {\n")
+		t.writeString(w, `"false"`)
+		io.WriteString(w, "}\n")
+	case info&types.IsUnsigned != 0:
+		t.writeAppend(w, "AppendUint", convert(typ, types.Typ[types.Uint64], value)+", 10")
+	case info&types.IsInteger != 0:
+		t.writeAppend(w, "AppendInt", convert(typ, types.Typ[types.Int64], value)+", 10")
+	case info&types.IsFloat != 0:
+		size := "64"
+		if basic.Kind() == types.Float32 {
+			size = "32"
+		}
+		t.writeAppend(w, "AppendFloat", convert(typ, types.Typ[types.Float64], value)+", 'g', -1, "+size)
+	default:
+		t.writeFmtPrint(w, value)
+	}
+}
+
+// writeString writes code that writes value, which is a string
+func (t *Translator) writeString(w io.Writer, value string) {
+	if t.appending {
+		fmt.Fprintf(w, "*w = append(*w, %s...)\n", value)
+		return
+	}
+	fmt.Fprintf(w, "_, _ = %s.WriteString(w, %s)\n", t.importPackage("io"), value)
+}
+
+// writeAppend writes code that calls the strconv append function with args.
+// Without a []byte to append to, it appends to the scratch buffer of the
+// function and writes that.
+func (t *Translator) writeAppend(w io.Writer, function, args string) {
+	strconv := t.importPackage("strconv")
+	if t.appending {
+		fmt.Fprintf(w, "*w = %s.%s(*w, %s)\n", strconv, function, args)
+		return
+	}
+	t.scratch = true
+	fmt.Fprintf(w, "_, _ = w.Write(%s.%s(scratch[:0], %s))\n", strconv, function, args)
+}
+
+func (t *Translator) writeFmtPrint(w io.Writer, value string) {
+	if t.appending {
+		fmt.Fprintf(w, "*w = %s.Append(*w, %s)\n", t.importPackage("fmt"), value)
+		return
+	}
+	fmt.Fprintf(w, "_, _ = %s.Fprint(w, %s)\n", t.importPackage("fmt"), value)
+}
+
+// convert returns value converted to the type to, unless it already has that type
+func convert(typ, to types.Type, value string) string {
+	if types.Identical(typ, to) {
+		return value
+	}
+	return fmt.Sprintf("%s(%s)", to, value)
+}
+
+func hasMethod(typ types.Type, name string) bool {
+	obj, _, _ := types.LookupFieldOrMethod(typ, false, nil, name)
+	_, ok := obj.(*types.Func)
+	return ok
+}
@@ -0,0 +1,140 @@
+package statictemplate
+
+import (
+	"go/types"
+	"testing"
+	"text/template"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrint(t *testing.T) {
+	p := types.NewPackage("bou.ke/shop", "shop")
+	price := types.NewNamed(types.NewTypeName(0, p, "Price", nil), types.Typ[types.Int], nil)
+	price.AddMethod(types.NewFunc(0, p, "String", types.NewSignature(types.NewVar(0, p, "", price), nil, types.NewTuple(types.NewVar(0, p, "", types.Typ[types.String])), false)))
+	typ := types.NewStruct([]*types.Var{
+		types.NewVar(0, p, "Count", types.Typ[types.Uint8]),
+		types.NewVar(0, p, "Weight", types.Typ[types.Float32]),
+		types.NewVar(0, p, "InStock", types.Typ[types.Bool]),
+		types.NewVar(0, p, "Price", price),
+		types.NewVar(0, p, "Discount", types.NewPointer(price)),
+		types.NewVar(0, p, "Err", types.Universe.Lookup("error").Type()),
+	}, nil)
+	temp := template.Must(template.New("index.tmpl").Parse(`{{ .Count }}{{ .Weight }}{{ .InStock }}{{ .Price }}{{ .Discount }}{{ .Err }}`))
+	actual, err := New(temp).Translate("main", []TranslateInstruction{
+		{"Index", "index.tmpl", typ},
+	})
+	if assert.NoError(t, err) {
+		equalish(t, `
+package main
+
+import (
+  pkg1 "bou.ke/shop"
+  "fmt"
+  "io"
+  "strconv"
+)
+
+func Index(w io.Writer, dot struct {
+  Count    uint8
+  Weight   float32
+  InStock  bool
+  Price    pkg1.Price
+  Discount *pkg1.Price
+  Err      error
+}) (err error) {
+  defer func() {
+    if recovered := recover(); recovered != nil {
+      var ok bool
+      if err, ok = recovered.(error); !ok {
+        panic(recovered)
+      }
+    }
+  }()
+  return fun0(w, dot)
+}
+
+// index.tmpl(struct{Count uint8; Weight float32; InStock bool; Price pkg1.Price; Discount *pkg1.Price; Err error})
+func fun0(w io.Writer, dot struct {
+  Count    uint8
+  Weight   float32
+  InStock  bool
+  Price    pkg1.Price
+  Discount *pkg1.Price
+  Err      error
+}) error {
+  var scratch [32]byte
+  _, _ = w.Write(strconv.AppendUint(scratch[:0], uint64(dot.Count), 10))
+  _, _ = w.Write(strconv.AppendFloat(scratch[:0], float64(dot.Weight), 'g', -1, 32))
+  if dot.InStock {
+    _, _ = io.WriteString(w, "true")
+  } else {
+    _, _ = io.WriteString(w, "false")
+  }
+  _, _ = io.WriteString(w, dot.Price.String())
+  if eval := dot.Discount; eval != nil {
+    _, _ = io.WriteString(w, eval.String())
+  } else {
+    _, _ = io.WriteString(w, func() (s string) {
+      defer func() {
+        if recover() != nil {
+          s = "<nil>"
+        }
+      }()
+      return eval.String()
+    }())
+  }
+  _, _ = fmt.Fprint(w, dot.Err)
+  return nil
+}`, actual, "print")
+	}
+}
+
+func TestPrintNilStringer(t *testing.T) {
+	p := types.NewPackage("bou.ke/shop", "shop")
+	node := types.NewNamed(types.NewTypeName(0, p, "Node", nil), types.NewStruct(nil, nil), nil)
+	// String has a pointer receiver and handles nil, so it's called for nil too
+	node.AddMethod(types.NewFunc(0, p, "String", types.NewSignature(types.NewVar(0, p, "", types.NewPointer(node)), nil, types.NewTuple(types.NewVar(0, p, "", types.Typ[types.String])), false)))
+	temp := template.Must(template.New("index.tmpl").Parse(`{{ . }}`))
+	actual, err := New(temp).Translate("main", []TranslateInstruction{
+		{"Index", "index.tmpl", types.NewPointer(node)},
+	})
+	if assert.NoError(t, err) {
+		equalish(t, `
+package main
+
+import (
+  pkg1 "bou.ke/shop"
+  "io"
+)
+
+func Index(w io.Writer, dot *pkg1.Node) (err error) {
+  defer func() {
+    if recovered := recover(); recovered != nil {
+      var ok bool
+      if err, ok = recovered.(error); !ok {
+        panic(recovered)
+      }
+    }
+  }()
+  return fun0(w, dot)
+}
+
+// index.tmpl(*pkg1.Node)
+func fun0(w io.Writer, dot *pkg1.Node) error {
+  if eval := dot; eval != nil {
+    _, _ = io.WriteString(w, eval.String())
+  } else {
+    _, _ = io.WriteString(w, func() (s string) {
+      defer func() {
+        if recover() != nil {
+          s = "<nil>"
+        }
+      }()
+      return eval.String()
+    }())
+  }
+  return nil
+}`, actual, "print")
+	}
+}
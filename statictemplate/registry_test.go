@@ -0,0 +1,131 @@
+package statictemplate
+
+import (
+	"go/types"
+	"testing"
+	"text/template"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry(t *testing.T) {
+	temp := template.Must(template.New("index.tmpl").Parse(`{{ . }}`))
+	translator := New(temp)
+	translator.Registry = "Templates"
+	actual, err := translator.Translate("main", []TranslateInstruction{
+		{"Index", "index.tmpl", types.Typ[types.String]},
+		{"IndexInt", "index.tmpl", types.Typ[types.Int]},
+	})
+	if assert.NoError(t, err) {
+		equalish(t, `
+package main
+
+import (
+  "fmt"
+  "io"
+  "strconv"
+)
+
+func Index(w io.Writer, dot string) (err error) {
+  defer func() {
+    if recovered := recover(); recovered != nil {
+      var ok bool
+      if err, ok = recovered.(error); !ok {
+        panic(recovered)
+      }
+    }
+  }()
+  return fun0(w, dot)
+}
+
+func IndexInt(w io.Writer, dot int) (err error) {
+  defer func() {
+    if recovered := recover(); recovered != nil {
+      var ok bool
+      if err, ok = recovered.(error); !ok {
+        panic(recovered)
+      }
+    }
+  }()
+  return fun1(w, dot)
+}
+
+// Templates executes the generated functions by the name of their template, like
+// (*template.Template).ExecuteTemplate
+var Templates templatesRegistry
+
+type templatesRegistry struct{}
+
+// ExecuteTemplate executes the function generated for the template with the
+// given name and the type of data
+func (templatesRegistry) ExecuteTemplate(w io.Writer, name string, data interface{}) error {
+  switch name {
+  case "index.tmpl":
+    switch dot := data.(type) {
+    case string:
+      return Index(w, dot)
+    case int:
+      return IndexInt(w, dot)
+    }
+    return fmt.Errorf("template: %s: expected data of type string or int, got %T", name, data)
+  }
+  return fmt.Errorf("template: no template %q associated with Templates", name)
+}
+
+// Lookup returns the template with the given name, or nil if no function is generated for it
+func (templatesRegistry) Lookup(name string) *templatesTemplate {
+  switch name {
+  case "index.tmpl":
+    return &templatesTemplate{name: name}
+  }
+  return nil
+}
+
+// templatesTemplate is a template in Templates
+type templatesTemplate struct {
+  name string
+}
+
+// Name returns the name of the template
+func (t *templatesTemplate) Name() string {
+  return t.name
+}
+
+// Execute executes the function generated for the template and the type of data
+func (t *templatesTemplate) Execute(w io.Writer, data interface{}) error {
+  return Templates.ExecuteTemplate(w, t.name, data)
+}
+
+// index.tmpl(string)
+func fun0(w io.Writer, dot string) error {
+  _, _ = io.WriteString(w, dot)
+  return nil
+}
+
+// index.tmpl(int)
+func fun1(w io.Writer, dot int) error {
+  var scratch [32]byte
+  _, _ = w.Write(strconv.AppendInt(scratch[:0], int64(dot), 10))
+  return nil
+}`, actual, "registry")
+	}
+}
+
+func TestRegistryNilDot(t *testing.T) {
+	temp := template.Must(template.New("index.tmpl").Parse(`{{ if . }}yes{{ end }}`))
+	translator := New(temp)
+	translator.Registry = "Templates"
+	actual, err := translator.Translate("main", []TranslateInstruction{
+		{"Index", "index.tmpl", types.Typ[types.String]},
+		{"IndexPointer", "index.tmpl", types.NewPointer(types.Typ[types.Int])},
+	})
+	if assert.NoError(t, err) {
+		// A nil dot is passed as a nil pointer, like *template.Template executes it
+		assert.Contains(t, string(actual), `
+		case *int:
+			return IndexPointer(w, dot)
+		case nil:
+			return IndexPointer(w, nil)
+		}`)
+	}
+}
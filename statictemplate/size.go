@@ -0,0 +1,80 @@
+package statictemplate
+
+import (
+	"text/template/parse"
+)
+
+// MinSize returns the minimum size of the output of the template with the
+// given name, which is the length of the text that's written on every path
+// through it. The template is either a *text/template.Template or a
+// *html/template.Template, whose escaped text is measured.
+func MinSize(template interface{}, name string) (int, error) {
+	return templateMinSize(wrap(template), name)
+}
+
+func templateMinSize(template wrappedTemplate, name string) (int, error) {
+	temp, err := template.Lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	return minSize(temp, temp.Tree().Root, map[string]bool{name: true}), nil
+}
+
+func minSize(temp wrappedTemplate, node parse.Node, visiting map[string]bool) int {
+	switch node := node.(type) {
+	case *parse.ListNode:
+		if node == nil {
+			return 0
+		}
+		var size int
+		for _, item := range node.Nodes {
+			size += minSize(temp, item, visiting)
+		}
+		return size
+	case *parse.TextNode:
+		return len(node.Text)
+	case *parse.IfNode:
+		return minBranchSize(temp, &node.BranchNode, visiting)
+	case *parse.WithNode:
+		return minBranchSize(temp, &node.BranchNode, visiting)
+	case *parse.RangeNode:
+		// The rest of an iteration is skipped by break and continue
+		if hasLoopControl(node.List) {
+			return 0
+		}
+		return minBranchSize(temp, &node.BranchNode, visiting)
+	case *parse.TemplateNode:
+		// Recursive templates can stop at any depth
+		if visiting[node.Name] {
+			return 0
+		}
+		called, err := temp.Lookup(node.Name)
+		if err != nil {
+			return 0
+		}
+		visiting[node.Name] = true
+		defer delete(visiting, node.Name)
+		return minSize(called, called.Tree().Root, visiting)
+	default:
+		return 0
+	}
+}
+
+// minBranchSize returns the minimum size of either branch
+func minBranchSize(temp wrappedTemplate, node *parse.BranchNode, visiting map[string]bool) int {
+	size := minSize(temp, node.List, visiting)
+	if elseSize := minSize(temp, node.ElseList, visiting); elseSize < size {
+		return elseSize
+	}
+	return size
+}
+
+func hasLoopControl(node parse.Node) (found bool) {
+	walkNodes(node, func(node parse.Node) {
+		switch node.(type) {
+		case *parse.BreakNode, *parse.ContinueNode:
+			found = true
+		}
+	})
+	return
+}
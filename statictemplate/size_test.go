@@ -0,0 +1,40 @@
+package statictemplate
+
+import (
+	htmlTemplate "html/template"
+	"testing"
+	"text/template"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMinSize(t *testing.T) {
+	for _, c := range []struct {
+		text string
+		size int
+	}{
+		{`hello {{ . }}`, 6},
+		{`{{ if . }}abc{{ else }}a{{ end }}`, 1},
+		{`{{ if . }}abc{{ end }}`, 0},
+		{`{{ range . }}ab{{ else }}abc{{ end }}`, 2},
+		{`{{ range . }}{{ if . }}{{ break }}{{ end }}ab{{ end }}`, 0},
+		{`<{{ template "list" . }}>{{ define "list" }}[{{ with . }}{{ template "list" . }}{{ end }}]{{ end }}`, 4},
+		{`{{/* comment */}}abc`, 3},
+	} {
+		temp := template.Must(template.New("index.tmpl").Parse(c.text))
+		size, err := MinSize(temp, "index.tmpl")
+		if assert.NoError(t, err, c.text) {
+			assert.Equal(t, c.size, size, c.text)
+		}
+	}
+
+	// The escaper can change the text of HTML templates
+	temp := htmlTemplate.Must(htmlTemplate.New("index.tmpl").Parse(`<p>{{ . }}</p><!-- removed -->`))
+	size, err := MinSize(temp, "index.tmpl")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 7, size)
+	}
+
+	_, err = MinSize(temp, "missing.tmpl")
+	assert.Error(t, err)
+}
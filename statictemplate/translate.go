@@ -2,27 +2,19 @@ package statictemplate
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"go/format"
 	"go/types"
 	"io"
 	"path"
+	"strings"
 	"text/template/parse"
 
 	"bou.ke/statictemplate/internal"
 	"golang.org/x/tools/go/types/typeutil"
 )
 
-var builtinFuncs map[string]*types.Func
-
-func init() {
-	var err error
-	_, _, builtinFuncs, err = internal.ImportFuncMap("bou.ke/statictemplate/funcs.Funcs")
-	if err != nil {
-		panic(err)
-	}
-}
-
 const varPrefix = "_Var"
 
 type scope map[string]types.Type
@@ -43,14 +35,93 @@ func Translate(template interface{}, pkg string, instructions []TranslateInstruc
 // Translator converts a template with a set of instructions to Go code
 type Translator struct {
 	Funcs map[string]*types.Func
+	// Context makes every generated function take a context.Context as its
+	// first argument. It is passed on to funcs that take a context.Context as
+	// their first parameter, and checked on every iteration of a range loop.
+	Context bool
+	// PackagePath is the import path of the package the code is generated
+	// into, if known. Types and funcs from it are referenced without importing it.
+	PackagePath string
+	// MissingKey is the missingkey option of the templates, which controls what
+	// happens when a map is indexed with a key that isn't in it. It's either
+	// "zero" or empty to return the zero value, or "error" to fail. The generated
+	// code can't print <no value>, so "default" and "invalid" aren't supported.
+	MissingKey string
+	// Registry is the name of a variable to generate with ExecuteTemplate and
+	// Lookup methods, which execute the generated functions by template name
+	// like a *template.Template, to replace one without changing its callers
+	Registry string
+	// Fallback makes Translate generate code that executes the parts of the
+	// templates that can't be translated with text/template at runtime, instead
+	// of failing. A part is an action, or the whole template if the action can't
+	// be executed on its own, like when it uses $.
+	Fallback bool
+	// Fallbacks are the parts that are executed at runtime, after Translate
+	Fallbacks []*Fallback
+	// Implementations are the concrete types the values of an interface type can
+	// have. A template whose dot has the interface type is generated for each of
+	// them, with a type switch that picks one at runtime and fails for other types.
+	Implementations map[types.Type][]types.Type
+	// String and Append generate companions of every function, named like it
+	// with a String or Append suffix, that return the output as a string or
+	// append it to a []byte, like XString(dot) (string, error) and
+	// XAppend(dst, dot) ([]byte, error). Both append to a []byte directly,
+	// instead of writing to an io.Writer.
+	String, Append bool
+	// Sizes makes Translate generate a constant with the MinSize of the output
+	// of every function, named like it with a MinSize suffix. The String and
+	// Append variants allocate that much up front.
+	Sizes bool
+	// AverageSizes are the average sizes of the output of functions by name, as
+	// observed in benchmarks or profiles. With Sizes, they're generated as
+	// constants with an AverageSize suffix, and the variants allocate that much
+	// if it's more than the minimum.
+	AverageSizes map[string]int
+	// StaticBytes makes the generated code write static text from package-level
+	// []byte variables, instead of string constants that are converted when
+	// the io.Writer doesn't have a WriteString method
+	StaticBytes bool
+	// Inline is the maximum number of nodes of a template that's called with
+	// {{template}} for it to be translated into the caller, instead of a call
+	// to the function generated from it. Recursive calls aren't inlined, and
+	// 0 disables inlining.
+	Inline int
+	// Handlers makes Translate generate a function for every function, named
+	// like it with a Handler suffix, that takes a func(*http.Request) (dot, error)
+	// loader and an error handler, and returns an http.Handler serving the output
+	// with an ETag
+	Handlers bool
+	// Buffered makes the generated functions render into a pooled buffer, and
+	// only write it to the io.Writer when the template succeeds, so an error
+	// doesn't leave half of the output written. New buffers are as big as the
+	// last output, or the size constant with Sizes.
+	Buffered bool
 
 	scopes               []scope
 	template             wrappedTemplate
+	tree                 *parse.Tree
 	id                   int
-	specializedFunctions map[wrappedTemplate]*typeutil.Map
+	specializedFunctions map[specialization]*typeutil.Map
 	errorFunctions       *typeutil.Map
+	mapIndexFunctions    *typeutil.Map
 	generatedFunctions   []string
 	imports              map[string]string
+	collectErrors        bool
+	errors               []error
+	// appending is set while generating the functions that append to a []byte
+	appending         bool
+	fallbackTemplates map[string]string
+	appendWriter      string
+	staticTexts       map[string]string
+	// inlining are the names of the templates whose code is being generated,
+	// which aren't inlined into themselves
+	inlining map[string]bool
+	// scratch is set when the function that's being generated needs a buffer
+	// to format numbers in
+	scratch bool
+	// builtins are the functions of the funcs package, which are loaded the
+	// first time templates are translated
+	builtins map[string]*types.Func
 }
 
 // New creates a new instance of Translator
@@ -62,8 +133,11 @@ func New(template interface{}) *Translator {
 		scopes: []scope{
 			make(scope),
 		},
-		specializedFunctions: make(map[wrappedTemplate]*typeutil.Map),
+		specializedFunctions: make(map[specialization]*typeutil.Map),
+		fallbackTemplates:    make(map[string]string),
+		staticTexts:          make(map[string]string),
 		errorFunctions:       &typeutil.Map{},
+		mapIndexFunctions:    &typeutil.Map{},
 		imports:              make(map[string]string),
 		template:             wrapped,
 	}
@@ -71,14 +145,24 @@ func New(template interface{}) *Translator {
 
 // Translate converts a template with a set of instructions to Go code
 func (t *Translator) Translate(pkg string, instructions []TranslateInstruction) ([]byte, error) {
+	var err error
+	if t.builtins, err = internal.Builtins(); err != nil {
+		return nil, err
+	}
 	var result []resultEntry
 
+	functionNames := make(map[string]bool)
 	for _, instruction := range instructions {
-		temp, err := t.template.Lookup(instruction.TemplateName)
-		if err != nil {
-			return nil, err
+		functionNames[instruction.FunctionName] = true
+	}
+	for name := range t.AverageSizes {
+		if !functionNames[name] {
+			return nil, fmt.Errorf("average size given for %s, which isn't a generated function", name)
 		}
-		functionName, err := t.generateTemplate(temp, instruction.Dot)
+	}
+
+	for _, instruction := range instructions {
+		functionName, err := t.translateInstruction(instruction)
 		if err != nil {
 			return nil, err
 		}
@@ -89,7 +173,36 @@ func (t *Translator) Translate(pkg string, instructions []TranslateInstruction)
 		})
 	}
 
+	var appendFunctions []string
+	if t.String || t.Append {
+		t.appending = true
+		for _, instruction := range instructions {
+			functionName, err := t.translateInstruction(instruction)
+			if err != nil {
+				return nil, err
+			}
+			appendFunctions = append(appendFunctions, functionName)
+		}
+		t.appending = false
+	}
+
 	t.importPackage("io")
+	if t.Registry != "" {
+		t.importPackage("fmt")
+	}
+	if t.Handlers {
+		for _, name := range []string{"bytes", "errors", "hash/fnv", "net/http", "strconv", "time"} {
+			t.importPackage(name)
+		}
+	}
+	var bufferPool string
+	if t.Buffered {
+		for _, name := range []string{"bytes", "sync", "sync/atomic"} {
+			t.importPackage(name)
+		}
+		bufferPool = t.generateFunctionName()
+		t.generatedFunctions = append(t.generatedFunctions, fmt.Sprintf(bufferPoolCode, bufferPool, bufferPool, bufferPool, bufferPool, bufferPool))
+	}
 
 	var buf bytes.Buffer
 
@@ -105,9 +218,48 @@ import (
 	}
 	io.WriteString(&buf, ")")
 
-	for _, entry := range result {
+	pools := make([]string, len(result))
+	renders := make([]string, len(result))
+	for i, entry := range result {
+		if t.Buffered {
+			pools[i] = t.generateFunctionName()
+			renders[i] = t.generateFunctionName()
+			fmt.Fprintf(&buf, `
+func %s(%sw io.Writer, dot %s) error {
+	buf, err := %s(%sdot)
+	if err != nil {
+		return err
+	}
+	defer %s.put(buf)
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// %s renders %s into a buffer from %s, which the caller puts back
+func %s(%sdot %s) (buf *bytes.Buffer, err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			var ok bool
+			if err, ok = recovered.(error); !ok {
+				panic(recovered)
+			}
+		}
+	}()
+	buf = %s.get()
+	if err = %s(%sbuf, dot); err != nil {
+		%s.put(buf)
+		return nil, err
+	}
+	%s.observe(buf.Len())
+	return buf, nil
+}
+`, entry.name, t.contextParam(), entry.typeName, renders[i], t.contextArg(), pools[i],
+				renders[i], entry.name, pools[i], renders[i], t.contextParam(), entry.typeName,
+				pools[i], entry.functionName, t.contextArg(), pools[i], pools[i])
+			continue
+		}
 		fmt.Fprintf(&buf, `
-func %s(w io.Writer, dot %s) (err error) {
+func %s(%sw io.Writer, dot %s) (err error) {
 	defer func() {
 		if recovered := recover(); recovered != nil {
 			var ok bool
@@ -116,9 +268,103 @@ func %s(w io.Writer, dot %s) (err error) {
 			}
 		}
 	}()
-	return %s(w, dot)
+	return %s(%sw, dot)
 }
-`, entry.name, entry.typeName, entry.functionName)
+`, entry.name, t.contextParam(), entry.typeName, entry.functionName, t.contextArg())
+	}
+	sizes := make([]string, len(result))
+	for i, entry := range result {
+		if !t.Sizes {
+			continue
+		}
+		minSize, err := templateMinSize(t.template, instructions[i].TemplateName)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&buf, "\nconst %sMinSize = %d\n", entry.name, minSize)
+		sizes[i] = entry.name + "MinSize"
+		if averageSize, ok := t.AverageSizes[entry.name]; ok {
+			fmt.Fprintf(&buf, "\nconst %sAverageSize = %d\n", entry.name, averageSize)
+			if averageSize > minSize {
+				sizes[i] = entry.name + "AverageSize"
+			}
+		}
+	}
+	for i, pool := range pools {
+		if pool == "" {
+			continue
+		}
+		if sizes[i] == "" {
+			t.generatedFunctions = append(t.generatedFunctions, fmt.Sprintf(`
+var %s %s`, pool, bufferPool))
+		} else {
+			t.generatedFunctions = append(t.generatedFunctions, fmt.Sprintf(`
+var %s = %s{size: %s}`, pool, bufferPool, sizes[i]))
+		}
+	}
+	for i, entry := range result {
+		if t.String {
+			fmt.Fprintf(&buf, `
+func %sString(%sdot %s) (s string, err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			var ok bool
+			if err, ok = recovered.(error); !ok {
+				panic(recovered)
+			}
+		}
+	}()
+	%s
+	err = %s(%s&b, dot)
+	return string(b), err
+}
+`, entry.name, t.contextParam(), entry.typeName, allocateBytes(sizes[i]), appendFunctions[i], t.contextArg())
+		}
+		if t.Append {
+			fmt.Fprintf(&buf, `
+func %sAppend(%sdst []byte, dot %s) (b []byte, err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			var ok bool
+			if err, ok = recovered.(error); !ok {
+				panic(recovered)
+			}
+		}
+	}()
+	b = dst%s
+	err = %s(%s&b, dot)
+	return b, err
+}
+`, entry.name, t.contextParam(), entry.typeName, growBytes(sizes[i]), appendFunctions[i], t.contextArg())
+		}
+	}
+
+	if t.Handlers {
+		entries := make([]internal.HandlerEntry, len(result))
+		for i, entry := range result {
+			entries[i] = internal.HandlerEntry{
+				FunctionName: entry.name,
+				Dot:          entry.typeName,
+				Size:         sizes[i],
+				Render:       renders[i],
+				Pool:         pools[i],
+			}
+		}
+		_, html := t.template.(htmlTemplateWrapper)
+		internal.WriteHandlers(&buf, internal.ContentType(html), t.Context, entries)
+	}
+
+	if t.Registry != "" {
+		entries := make([]internal.RegistryEntry, len(instructions))
+		for i, instruction := range instructions {
+			entries[i] = internal.RegistryEntry{
+				TemplateName: instruction.TemplateName,
+				FunctionName: instruction.FunctionName,
+				Dot:          result[i].typeName,
+				Type:         types.TypeString(instruction.Dot, (*types.Package).Name),
+			}
+		}
+		internal.WriteRegistry(&buf, t.Registry, t.Context, entries)
 	}
 
 	for _, code := range t.generatedFunctions {
@@ -130,9 +376,128 @@ func %s(w io.Writer, dot %s) (err error) {
 	if err != nil {
 		return nil, fmt.Errorf("%s: %v", buf.String(), err)
 	}
+	if len(t.Fallbacks) != 0 {
+		return removeUnusedImports(formatted)
+	}
 	return formatted, nil
 }
 
+// bufferPoolCode is the type of the pools of buffers the functions render into
+// with Buffered. Only successful renders count towards the size of new buffers,
+// and buffers that grew too big aren't kept, so a single large output doesn't
+// stay in memory.
+const bufferPoolCode = `
+// %s is a pool of buffers, whose new buffers are as big as the moving average of the output
+type %s struct {
+	// size is first, to be aligned for atomic operations
+	size int64
+	pool sync.Pool
+}
+
+func (p *%s) get() *bytes.Buffer {
+	if buf, ok := p.pool.Get().(*bytes.Buffer); ok {
+		return buf
+	}
+	return bytes.NewBuffer(make([]byte, 0, atomic.LoadInt64(&p.size)))
+}
+
+// observe moves the size of new buffers an eighth of the way to the size of an output
+func (p *%s) observe(size int) {
+	old := atomic.LoadInt64(&p.size)
+	if average := old + (int64(size)-old)/8; average != old {
+		atomic.StoreInt64(&p.size, average)
+	}
+}
+
+func (p *%s) put(buf *bytes.Buffer) {
+	if buf.Cap() <= 1<<20 {
+		buf.Reset()
+		p.pool.Put(buf)
+	}
+}`
+
+// keyLess returns the expression that's true when map key a sorts before b,
+// in the order of text/template's fmtsort: false before true, NaN before other
+// floats, and complex numbers by their real and then their imaginary part
+func keyLess(key *types.Basic, a, b string) string {
+	switch {
+	case key.Info()&types.IsBoolean != 0:
+		return fmt.Sprintf("!%s && %s", a, b)
+	case key.Info()&types.IsFloat != 0:
+		return floatLess(a, b)
+	case key.Info()&types.IsComplex != 0:
+		ra, rb := "real("+a+")", "real("+b+")"
+		ia, ib := "imag("+a+")", "imag("+b+")"
+		return fmt.Sprintf("%s || (%s == %s || %s != %s && %s != %s) && (%s)", floatLess(ra, rb), ra, rb, ra, ra, rb, rb, floatLess(ia, ib))
+	default:
+		return a + " < " + b
+	}
+}
+
+// floatLess returns the expression that's true when float a sorts before b,
+// with NaN first
+func floatLess(a, b string) string {
+	return fmt.Sprintf("%s < %s || %s != %s && %s == %s", a, b, a, a, b, b)
+}
+
+// allocateBytes returns the declaration of the []byte the String variant appends to
+func allocateBytes(size string) string {
+	if size == "" {
+		return "var b []byte"
+	}
+	return fmt.Sprintf("b := make([]byte, 0, %s)", size)
+}
+
+// growBytes returns the code that makes room in b for the Append variant
+func growBytes(size string) string {
+	if size == "" {
+		return ""
+	}
+	return fmt.Sprintf(`
+	if cap(b)-len(b) < %s {
+		b = append(make([]byte, 0, len(b)+%s), b...)
+	}`, size, size)
+}
+
+// Check type checks the instructions like Translate, without generating code.
+// Instead of stopping at the first error it returns every error it finds, which
+// are of type *Error if they can be traced back to a node in the template.
+// Check shares its state with Translate, so use a new Translator for each.
+func (t *Translator) Check(instructions []TranslateInstruction) []error {
+	var err error
+	if t.builtins, err = internal.Builtins(); err != nil {
+		return []error{err}
+	}
+	t.collectErrors = true
+	for _, instruction := range instructions {
+		if _, err := t.translateInstruction(instruction); err != nil {
+			t.errors = append(t.errors, err)
+		}
+	}
+
+	// Errors in templates that are called from multiple places are found once per call
+	var errs []error
+	seen := make(map[string]bool)
+	for _, err := range t.errors {
+		if !seen[err.Error()] {
+			seen[err.Error()] = true
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+func (t *Translator) translateInstruction(instruction TranslateInstruction) (string, error) {
+	if t.MissingKey != "" && t.MissingKey != "zero" && t.MissingKey != "error" {
+		return "", fmt.Errorf("unsupported missingkey option %q, expected zero or error", t.MissingKey)
+	}
+	temp, err := t.template.Lookup(instruction.TemplateName)
+	if err != nil {
+		return "", err
+	}
+	return t.generateTemplate(temp, instruction.Dot)
+}
+
 func (t *Translator) importPackage(name string) string {
 	if pkg, ok := t.imports[name]; ok {
 		return pkg
@@ -140,8 +505,10 @@ func (t *Translator) importPackage(name string) string {
 
 	var pkg string
 	switch name {
-	case "fmt", "io":
+	case "bytes", "context", "errors", "fmt", "io", "sort", "strconv", "sync", "time":
 		pkg = name
+	case "hash/fnv", "net/http", "sync/atomic":
+		pkg = path.Base(name)
 	case "text/template":
 		pkg = "template"
 	case "bou.ke/statictemplate/funcs":
@@ -155,6 +522,23 @@ func (t *Translator) importPackage(name string) string {
 	return pkg
 }
 
+// contextParam returns the context parameter declaration for generated functions
+func (t *Translator) contextParam() string {
+	if !t.Context {
+		return ""
+	}
+	t.importPackage("context")
+	return "ctx context.Context, "
+}
+
+// contextArg returns the context argument passed on to generated functions
+func (t *Translator) contextArg() string {
+	if !t.Context {
+		return ""
+	}
+	return "ctx, "
+}
+
 func (t *Translator) generateFunctionName() string {
 	name := fmt.Sprintf("fun%d", t.id)
 	t.id++
@@ -186,7 +570,7 @@ func (t *Translator) findVariable(name string) (types.Type, error) {
 			return typ, nil
 		}
 	}
-	return nil, fmt.Errorf("can't find variable %s in scope", name)
+	return nil, fmt.Errorf("can't find variable $%s in scope", name)
 }
 
 type sortedTypes []types.Type
@@ -203,6 +587,12 @@ func (a sortedTypes) Less(i, j int) bool {
 	}
 }
 
+// specialization is a template and whether its functions append to a []byte
+type specialization struct {
+	template  wrappedTemplate
+	appending bool
+}
+
 type resultEntry struct {
 	name, typeName, functionName string
 }
@@ -238,37 +628,57 @@ func (t *Translator) translateNode(w io.Writer, node parse.Node, dot types.Type)
 		}
 
 		if len(node.Pipe.Decl) == 0 {
-			basic, ok := typ.(*types.Basic)
-			if ok && basic.Kind() == types.String {
-				t.importPackage("io")
-				io.WriteString(w, "_, _ = io.WriteString(w, ")
-			} else {
-				t.importPackage("fmt")
-				io.WriteString(w, "_, _ = fmt.Fprint(w, ")
-			}
-			writer.(*bytes.Buffer).WriteTo(w)
-			io.WriteString(w, ")")
+			t.writePrint(w, typ, writer.(*bytes.Buffer).String())
+			return nil
 		}
 		_, err = io.WriteString(w, "\n")
 
 		return err
+	case *parse.CommentNode:
+		// Comments are only in the tree when parsing with parse.ParseComments
+		return nil
 	case *parse.IfNode:
 		return t.translateScoped(w, dot, node.Type(), node.Pipe, node.List, node.ElseList)
 	case *parse.ListNode:
+		// Text and actions with constant output are written together
+		var static strings.Builder
 		for _, item := range node.Nodes {
-			if err := t.translateNode(w, item, dot); err != nil {
-				return err
+			if text, ok := t.constantOutput(item, nil, nil); ok {
+				static.WriteString(text)
+				continue
+			}
+			t.writeText(w, static.String())
+			static.Reset()
+			depth, scratch := len(t.scopes), t.scratch
+			// Items are translated separately, so the code of one that fails can be discarded
+			var buf bytes.Buffer
+			if err := t.translateNode(&buf, item, dot); err != nil {
+				err = t.errorAt(item, err)
+				t.scopes, t.scratch = t.scopes[:depth], scratch
+				if t.Fallback && !t.collectErrors {
+					buf.Reset()
+					if !t.fallbackNode(&buf, item, dot, err) {
+						return err
+					}
+					t.invalidateDeclarations(item)
+				} else if !t.collectErrors {
+					return err
+				} else {
+					t.collectError(item, err)
+					continue
+				}
 			}
+			buf.WriteTo(w)
 		}
+		t.writeText(w, static.String())
 		return nil
 	case *parse.RangeNode:
 		return t.translateScoped(w, dot, node.Type(), node.Pipe, node.List, node.ElseList)
 	case *parse.TemplateNode:
 		return t.translateTemplate(w, dot, node)
 	case *parse.TextNode:
-		t.importPackage("io")
-		_, err := fmt.Fprintf(w, "_, _ = io.WriteString(w, %q)\n", node.Text)
-		return err
+		t.writeText(w, string(node.Text))
+		return nil
 	case *parse.WithNode:
 		return t.translateScoped(w, dot, node.Type(), node.Pipe, node.List, node.ElseList)
 	default:
@@ -276,6 +686,27 @@ func (t *Translator) translateNode(w io.Writer, node parse.Node, dot types.Type)
 	}
 }
 
+// collectError records the error and continues after the node that caused it.
+// Variables declared by the node are marked invalid, so their uses aren't reported.
+func (t *Translator) collectError(node parse.Node, err error) {
+	if !errors.Is(err, errInvalid) {
+		t.errors = append(t.errors, err)
+	}
+	t.invalidateDeclarations(node)
+}
+
+// invalidateDeclarations marks the variables the node declares as invalid, as
+// their type isn't known
+func (t *Translator) invalidateDeclarations(node parse.Node) {
+	if action, ok := node.(*parse.ActionNode); ok {
+		for _, decl := range action.Pipe.Decl {
+			if ident := decl.Ident[0][1:]; !t.inScope(ident) {
+				t.addToScope(ident, types.Typ[types.Invalid])
+			}
+		}
+	}
+}
+
 func typeIsNil(typ types.Type) bool {
 	return typ == nil || types.Identical(typ, types.Typ[types.UntypedNil])
 }
@@ -285,7 +716,7 @@ func writeTruthiness(w io.Writer, typ types.Type) error {
 		_, err := io.WriteString(w, "eval != nil")
 		return err
 	}
-	switch typ := typ.(type) {
+	switch typ := typ.Underlying().(type) {
 	case *types.Array, *types.Map, *types.Slice:
 		_, err := io.WriteString(w, "len(eval) != 0")
 		return err
@@ -302,7 +733,7 @@ func writeTruthiness(w io.Writer, typ types.Type) error {
 			return err
 		}
 		return fmt.Errorf("don't know how to evaluate %s", typ)
-	case *types.Pointer, *types.Chan:
+	case *types.Pointer, *types.Chan, *types.Interface, *types.Signature:
 		_, err := io.WriteString(w, "eval != nil")
 		return err
 	case *types.Struct:
@@ -314,10 +745,10 @@ func writeTruthiness(w io.Writer, typ types.Type) error {
 }
 
 func (t *Translator) generateTemplate(temp wrappedTemplate, typ types.Type) (string, error) {
-	funcs, ok := t.specializedFunctions[temp]
+	funcs, ok := t.specializedFunctions[specialization{temp, t.appending}]
 	if !ok {
 		funcs = &typeutil.Map{}
-		t.specializedFunctions[temp] = funcs
+		t.specializedFunctions[specialization{temp, t.appending}] = funcs
 	}
 	functionName, ok := funcs.At(typ).(string)
 	if !ok {
@@ -336,15 +767,43 @@ func (t *Translator) generateTemplate(temp wrappedTemplate, typ types.Type) (str
 		} else {
 			buf.WriteString(typeName)
 		}
-		t.importPackage("io")
-		fmt.Fprintf(&buf, ")\nfunc %s(w io.Writer, dot %s) error {\n", functionName, typeName)
-		oldScopes := t.scopes
-		t.scopes = []scope{make(scope)}
-		if err := t.translateNode(&buf, temp.Tree().Root, typ); err != nil {
+		writer := "*[]byte"
+		if t.appending {
+			buf.WriteString(", appending")
+		} else {
+			t.importPackage("io")
+			writer = "io.Writer"
+		}
+		fmt.Fprintf(&buf, ")\nfunc %s(%sw %s, dot %s) error {\n", functionName, t.contextParam(), writer, typeName)
+		header := buf.Len()
+		oldScopes, oldTree, oldInlining, oldScratch := t.scopes, t.tree, t.inlining, t.scratch
+		t.scopes, t.tree, t.inlining, t.scratch = []scope{make(scope)}, temp.Tree(), map[string]bool{temp.Name(): true}, false
+		var err error
+		if implementations := t.implementations(typ); implementations != nil {
+			err = t.translateTypeSwitch(&buf, temp, typ, implementations)
+		} else if err = t.translateNode(&buf, temp.Tree().Root, typ); err == nil {
+			buf.WriteString("return nil\n")
+		}
+		if err != nil && t.Fallback && !t.collectErrors {
+			buf.Truncate(header)
+			t.scratch = false
+			if t.fallbackTemplate(&buf, temp, err) {
+				err = nil
+			}
+		}
+		if t.scratch {
+			body := buf.String()
+			buf.Truncate(header)
+			buf.WriteString("var scratch [32]byte\n")
+			buf.WriteString(body[header:])
+		}
+		t.scopes, t.tree, t.inlining, t.scratch = oldScopes, oldTree, oldInlining, oldScratch
+		if err != nil {
+			// Don't refer to the function from elsewhere, as it isn't generated
+			funcs.Delete(typ)
 			return "", err
 		}
-		t.scopes = oldScopes
-		buf.WriteString("return nil\n}\n")
+		buf.WriteString("}\n")
 
 		t.generatedFunctions = append(t.generatedFunctions, buf.String())
 	}
@@ -352,6 +811,77 @@ func (t *Translator) generateTemplate(temp wrappedTemplate, typ types.Type) (str
 	return functionName, nil
 }
 
+// inlineTemplate writes the code of a template that's called with dotCode into
+// the caller, in a block with its own dot. It returns false if the template is
+// too large, recursive, or can't be translated, so it should be called instead.
+func (t *Translator) inlineTemplate(w io.Writer, temp wrappedTemplate, typ types.Type, dotCode string) bool {
+	if t.Inline <= 0 || t.collectErrors || t.inlining[temp.Name()] || t.implementations(typ) != nil {
+		return false
+	}
+	var size int
+	walkNodes(temp.Tree().Root, func(parse.Node) {
+		size++
+	})
+	if size > t.Inline {
+		return false
+	}
+
+	typeName := "interface{}"
+	if !typeIsNil(typ) {
+		typeName = t.typeName(typ)
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// %s(%s), inlined\n{\nvar dot %s = %s\n_ = dot\n", temp.Name(), typeName, typeName, dotCode)
+	oldScopes, oldTree, oldScratch, fallbacks := t.scopes, t.tree, t.scratch, len(t.Fallbacks)
+	t.scopes, t.tree = []scope{make(scope)}, temp.Tree()
+	t.inlining[temp.Name()] = true
+	err := t.translateNode(&buf, temp.Tree().Root, typ)
+	delete(t.inlining, temp.Name())
+	t.scopes, t.tree = oldScopes, oldTree
+	if err != nil {
+		// The call reports the parts that are executed at runtime
+		t.Fallbacks, t.scratch = t.Fallbacks[:fallbacks], oldScratch
+		return false
+	}
+	buf.WriteString("}\n")
+	buf.WriteTo(w)
+	return true
+}
+
+// implementations returns the implementations listed for typ, or nil if it isn't an interface type with any
+func (t *Translator) implementations(typ types.Type) []types.Type {
+	if typeIsNil(typ) || !types.IsInterface(typ) {
+		return nil
+	}
+	for iface, implementations := range t.Implementations {
+		if types.Identical(iface, typ) {
+			return implementations
+		}
+	}
+	return nil
+}
+
+// translateTypeSwitch writes a type switch that calls the function generated
+// from the template for each implementation of the interface type of dot
+func (t *Translator) translateTypeSwitch(w io.Writer, temp wrappedTemplate, typ types.Type, implementations []types.Type) error {
+	io.WriteString(w, "switch dot := dot.(type) {\n")
+	for _, implementation := range implementations {
+		if types.IsInterface(implementation) {
+			return fmt.Errorf("implementation %s of %s isn't a concrete type", implementation, typ)
+		} else if !types.AssignableTo(implementation, typ) {
+			return fmt.Errorf("%s doesn't implement %s", implementation, typ)
+		}
+		name, err := t.generateTemplate(temp, implementation)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "case %s:\nreturn %s(%sw, dot)\n", t.typeName(implementation), name, t.contextArg())
+	}
+	_, err := fmt.Fprintf(w, "}\nreturn %s.Errorf(\"template: %%s: %%T isn't a listed implementation of %%s\", %q, dot, %q)\n",
+		t.importPackage("fmt"), temp.Name(), types.TypeString(typ, (*types.Package).Name))
+	return err
+}
+
 func (t *Translator) translateTemplate(w io.Writer, dot types.Type, node *parse.TemplateNode) error {
 	var buf bytes.Buffer
 	typ, err := t.translatePipe(&buf, dot, node.Pipe)
@@ -362,12 +892,15 @@ func (t *Translator) translateTemplate(w io.Writer, dot types.Type, node *parse.
 	if err != nil {
 		return err
 	}
+	if t.inlineTemplate(w, temp, typ, buf.String()) {
+		return nil
+	}
 	name, err := t.generateTemplate(temp, typ)
 	if err != nil {
 		return err
 	}
 
-	fmt.Fprintf(w, "if err := %s(w, ", name)
+	fmt.Fprintf(w, "if err := %s(%sw, ", name, t.contextArg())
 	buf.WriteTo(w)
 	_, err = io.WriteString(w, "); err != nil {\nreturn err\n}\n")
 	return err
@@ -392,32 +925,70 @@ func (t *Translator) translateScoped(w io.Writer, dot types.Type, nodeType parse
 
 	if nodeType == parse.NodeRange {
 		var elem types.Type
-		switch typ := typ.(type) {
+		switch typ := typ.Underlying().(type) {
 		case *types.Chan:
 			elem = typ.Elem()
-		case *types.Slice:
-			elem = typ.Elem()
-		case *types.Array:
+			switch len(pipe.Decl) {
+			case 0:
+				io.WriteString(w, "for dot := range eval {\n_ = dot\n")
+			case 1:
+				ident := pipe.Decl[0].Ident[0][1:]
+				fmt.Fprintf(w, "for %s%s := range eval {\ndot := %s%s\n_ = dot\n", varPrefix, ident, varPrefix, ident)
+				t.addToScope(ident, elem)
+			default:
+				return fmt.Errorf("too many declarations for range over channel")
+			}
+		case *types.Map:
 			elem = typ.Elem()
+			key, ok := typ.Key().Underlying().(*types.Basic)
+			if !ok || key.Kind() == types.UnsafePointer {
+				return fmt.Errorf("range over map with unsupported key type %s", typ.Key())
+			}
+			// Maps are iterated in sorted key order, like text/template does. The
+			// entries are sorted rather than the keys, as a NaN key can't be looked up
+			t.importPackage("sort")
+			fmt.Fprintf(w, "type entry struct {\nkey %s\nvalue %s\n}\n", t.typeName(typ.Key()), t.typeName(elem))
+			io.WriteString(w, "entries := make([]entry, 0, len(eval))\nfor key, value := range eval {\nentries = append(entries, entry{key, value})\n}\n")
+			fmt.Fprintf(w, "sort.Slice(entries, func(i, j int) bool { return %s })\n", keyLess(key, "entries[i].key", "entries[j].key"))
+			switch len(pipe.Decl) {
+			case 0:
+				io.WriteString(w, "for _, e := range entries {\ndot := e.value\n_ = dot\n")
+			case 1:
+				ident := pipe.Decl[0].Ident[0][1:]
+				fmt.Fprintf(w, "for _, e := range entries {\n%s%s := e.value\ndot := %s%s\n_ = dot\n", varPrefix, ident, varPrefix, ident)
+				t.addToScope(ident, elem)
+			case 2:
+				index := pipe.Decl[0].Ident[0][1:]
+				ident := pipe.Decl[1].Ident[0][1:]
+				t.addToScope(index, typ.Key())
+				t.addToScope(ident, elem)
+				fmt.Fprintf(w, "for _, e := range entries {\n%s%s, %s%s := e.key, e.value\ndot := %s%s\n_ = dot\n", varPrefix, index, varPrefix, ident, varPrefix, ident)
+			default:
+				return fmt.Errorf("too many declarations for range")
+			}
+		case *types.Slice, *types.Array:
+			elem = typ.(interface{ Elem() types.Type }).Elem()
+			switch len(pipe.Decl) {
+			case 0:
+				io.WriteString(w, "for _, dot := range eval {\n_ = dot\n")
+			case 1:
+				ident := pipe.Decl[0].Ident[0][1:]
+				fmt.Fprintf(w, "for _, %s%s := range eval {\ndot := %s%s\n_ = dot\n", varPrefix, ident, varPrefix, ident)
+				t.addToScope(ident, elem)
+			case 2:
+				index := pipe.Decl[0].Ident[0][1:]
+				ident := pipe.Decl[1].Ident[0][1:]
+				t.addToScope(index, types.Typ[types.Int])
+				t.addToScope(ident, elem)
+				fmt.Fprintf(w, "for %s%s, %s%s := range eval {\n_ = %s%s\ndot := %s%s\n_ = dot\n", varPrefix, index, varPrefix, ident, varPrefix, index, varPrefix, ident)
+			default:
+				return fmt.Errorf("too many declarations for range")
+			}
 		default:
-			return fmt.Errorf("range over non-iterable: %v", pipe.Pos)
+			return fmt.Errorf("range can't iterate over %s", typ)
 		}
-
-		switch len(pipe.Decl) {
-		case 0:
-			io.WriteString(w, "for _, dot := range eval {\n_ = dot\n")
-		case 1:
-			ident := pipe.Decl[0].Ident[0][1:]
-			fmt.Fprintf(w, "for _, %s%s := range eval {\ndot := %s%s\n_ = dot\n", varPrefix, ident, varPrefix, ident)
-			t.addToScope(ident, elem)
-		case 2:
-			index := pipe.Decl[0].Ident[0][1:]
-			ident := pipe.Decl[1].Ident[0][1:]
-			t.addToScope(index, types.Typ[types.Int64])
-			t.addToScope(ident, elem)
-			fmt.Fprintf(w, "for %s%s, %s%s := range eval {\n_ = %s%s\ndot := %s%s\n_ = dot\n", varPrefix, index, varPrefix, ident, varPrefix, index, varPrefix, ident)
-		default:
-			return fmt.Errorf("too many declarations for range")
+		if t.Context {
+			io.WriteString(w, "if err := ctx.Err(); err != nil {\nreturn err\n}\n")
 		}
 
 		if err := t.translateNode(w, list, elem); err != nil {
@@ -463,29 +1034,94 @@ func (t *Translator) translatePipe(w io.Writer, dot types.Type, pipe *parse.Pipe
 	}
 }
 
-func (t *Translator) translateCall(w io.Writer, dot types.Type, args []parse.Node, nextCommands []*parse.CommandNode) error {
+func (t *Translator) translateCall(w io.Writer, dot types.Type, name string, sig *types.Signature, withContext bool, args []parse.Node, nextCommands []*parse.CommandNode) error {
+	params := sig.Params()
+	offset := 0
+	if withContext {
+		offset = 1
+	}
+	numIn := len(args)
+	if len(nextCommands) != 0 {
+		numIn++
+	}
+	if numParams := params.Len() - offset; sig.Variadic() && numIn < numParams-1 || !sig.Variadic() && numIn != numParams {
+		if sig.Variadic() {
+			return fmt.Errorf("wrong number of args for %s: want at least %d got %d", name, numParams-1, numIn)
+		}
+		return fmt.Errorf("wrong number of args for %s: want %d got %d", name, numParams, numIn)
+	}
+	param := func(i int) types.Type {
+		i += offset
+		if sig.Variadic() && i >= params.Len()-1 {
+			return params.At(params.Len() - 1).Type().(*types.Slice).Elem()
+		}
+		return params.At(i).Type()
+	}
+
 	io.WriteString(w, "(")
+	if withContext {
+		io.WriteString(w, "ctx")
+	}
 	for i, arg := range args {
-		if i != 0 {
+		if i != 0 || withContext {
 			io.WriteString(w, ", ")
 		}
-		if _, err := t.translateArg(w, dot, arg); err != nil {
+		typ, err := t.translateArg(w, dot, arg)
+		if err != nil {
 			return err
 		}
+		if err := checkArg(arg, typ, param(i)); err != nil {
+			return t.errorAt(arg, err)
+		}
 	}
 	if len(nextCommands) != 0 {
-		if len(args) != 0 {
+		if len(args) != 0 || withContext {
 			io.WriteString(w, ", ")
 		}
-		if _, err := t.translateCommand(w, dot, nextCommands[len(nextCommands)-1], nextCommands[:len(nextCommands)-1]); err != nil {
+		cmd := nextCommands[len(nextCommands)-1]
+		typ, err := t.translateCommand(w, dot, cmd, nextCommands[:len(nextCommands)-1])
+		if err != nil {
 			return err
 		}
+		if err := checkArg(cmd, typ, param(len(args))); err != nil {
+			return t.errorAt(cmd, err)
+		}
 	}
 	io.WriteString(w, ")")
 	return nil
 }
 
-func (t *Translator) translateCommand(w io.Writer, dot types.Type, cmd *parse.CommandNode, nextCommands []*parse.CommandNode) (types.Type, error) {
+// checkArg checks that the result of the argument can be passed as a parameter of type param
+func checkArg(arg parse.Node, typ, param types.Type) error {
+	// Constants are untyped in the generated code
+	switch arg := arg.(type) {
+	case *parse.BoolNode:
+		typ = types.Typ[types.UntypedBool]
+	case *parse.NumberNode:
+		if ideal, err := idealConstant(arg); err == nil && ideal.Kind() == types.Int {
+			typ = types.Typ[types.UntypedInt]
+		} else if err == nil && ideal.Kind() == types.Float64 {
+			typ = types.Typ[types.UntypedFloat]
+		}
+	case *parse.StringNode:
+		typ = types.Typ[types.UntypedString]
+	}
+	if typ == nil {
+		// nil dots are passed around as interface{}
+		typ = types.NewInterfaceType(nil, nil)
+	}
+	if !types.AssignableTo(typ, param) {
+		return fmt.Errorf("wrong type for value; expected %s; got %s", param, typ)
+	}
+	return nil
+}
+
+func (t *Translator) translateCommand(w io.Writer, dot types.Type, cmd *parse.CommandNode, nextCommands []*parse.CommandNode) (typ types.Type, err error) {
+	defer func() {
+		if err != nil {
+			err = t.errorAt(cmd, err)
+		}
+	}()
 	action := cmd.Args[0]
 	args := cmd.Args[1:]
 
@@ -517,21 +1153,7 @@ func (t *Translator) translateCommand(w io.Writer, dot types.Type, cmd *parse.Co
 	case *parse.NilNode:
 		return nil, fmt.Errorf("nil is not a command")
 	case *parse.NumberNode:
-		if action.IsInt {
-			_, err := fmt.Fprint(w, action.Int64)
-			return types.Typ[types.Int64], err
-		} else if action.IsUint {
-			_, err := fmt.Fprint(w, action.Uint64)
-			return types.Typ[types.Uint64], err
-		} else if action.IsFloat {
-			_, err := fmt.Fprint(w, action.Float64)
-			return types.Typ[types.Float64], err
-		} else if action.IsComplex {
-			_, err := fmt.Fprint(w, action.Complex128)
-			return types.Typ[types.Complex128], err
-		} else {
-			return nil, fmt.Errorf("unknown number node %v", action)
-		}
+		return translateNumber(w, action)
 	case *parse.StringNode:
 		_, err := fmt.Fprintf(w, "%q", action.Text)
 		return types.Typ[types.String], err
@@ -540,7 +1162,12 @@ func (t *Translator) translateCommand(w io.Writer, dot types.Type, cmd *parse.Co
 	}
 }
 
-func (t *Translator) translateArg(w io.Writer, dot types.Type, arg parse.Node) (types.Type, error) {
+func (t *Translator) translateArg(w io.Writer, dot types.Type, arg parse.Node) (typ types.Type, err error) {
+	defer func() {
+		if err != nil {
+			err = t.errorAt(arg, err)
+		}
+	}()
 	switch arg := arg.(type) {
 	case *parse.BoolNode:
 		_, err := fmt.Fprint(w, arg.True)
@@ -558,12 +1185,7 @@ func (t *Translator) translateArg(w io.Writer, dot types.Type, arg parse.Node) (
 		_, err := io.WriteString(w, "nil")
 		return types.Typ[types.UntypedNil], err
 	case *parse.NumberNode:
-		if arg.IsInt {
-			_, err := fmt.Fprint(w, arg.Int64)
-			return types.Typ[types.Int64], err
-		} else {
-			return nil, fmt.Errorf("unknown number node %v", arg)
-		}
+		return translateNumber(w, arg)
 	case *parse.PipeNode:
 		if len(arg.Decl) > 0 {
 			// TODO(bouk): do (is it even possible?)
@@ -580,6 +1202,45 @@ func (t *Translator) translateArg(w io.Writer, dot types.Type, arg parse.Node) (
 	}
 }
 
+// translateNumber writes a number as an untyped constant, whose default type
+// is the type text/template gives it
+func translateNumber(w io.Writer, node *parse.NumberNode) (types.Type, error) {
+	typ, err := idealConstant(node)
+	if err != nil {
+		return nil, err
+	}
+	switch typ.Kind() {
+	case types.Int:
+		_, err = fmt.Fprint(w, node.Int64)
+	case types.Float64:
+		// The text keeps the decimal point or exponent that makes it a float
+		_, err = io.WriteString(w, node.Text)
+	default:
+		_, err = fmt.Fprint(w, node.Complex128)
+	}
+	return typ, err
+}
+
+// idealConstant returns the type text/template gives a number: complex128 for
+// complex numbers, float64 for ones written like a float, and int otherwise
+func idealConstant(node *parse.NumberNode) (*types.Basic, error) {
+	text := node.Text
+	isHexInt := len(text) > 2 && text[0] == '0' && (text[1] == 'x' || text[1] == 'X') && !strings.ContainsAny(text, "pP")
+	isRuneInt := len(text) > 0 && text[0] == '\''
+	switch {
+	case node.IsComplex:
+		return types.Typ[types.Complex128], nil
+	case node.IsFloat && !isHexInt && !isRuneInt && strings.ContainsAny(text, ".eEpP"):
+		return types.Typ[types.Float64], nil
+	case node.IsInt && int64(int(node.Int64)) == node.Int64:
+		return types.Typ[types.Int], nil
+	case node.IsInt || node.IsUint:
+		return nil, fmt.Errorf("%s overflows int", text)
+	default:
+		return nil, fmt.Errorf("unknown number node %v", node)
+	}
+}
+
 func (t *Translator) translateChain(w io.Writer, dot types.Type, node *parse.ChainNode, args []parse.Node, nextCommands []*parse.CommandNode) (types.Type, error) {
 	var buf bytes.Buffer
 	typ, err := t.translateArg(&buf, dot, node.Node)
@@ -598,6 +1259,9 @@ func (t *Translator) translateVariable(w io.Writer, dot types.Type, node *parse.
 	if err != nil {
 		return nil, err
 	}
+	if typ == types.Typ[types.Invalid] {
+		return nil, errInvalid
+	}
 
 	return t.translateFieldChain(w, dot, constantWriterTo(varPrefix+ident), typ, node.Ident[1:], args, nextCommands)
 }
@@ -620,13 +1284,32 @@ func %s(value %s, err error) %s {
 	return name
 }
 
+// generateMapIndexFunction generates a function that indexes a map of type typ,
+// and fails if the key isn't in it
+func (t *Translator) generateMapIndexFunction(typ types.Type) string {
+	name, ok := t.mapIndexFunctions.At(typ).(string)
+	if !ok {
+		name = t.generateFunctionName()
+		m := typ.Underlying().(*types.Map)
+
+		t.generatedFunctions = append(t.generatedFunctions, fmt.Sprintf(`
+func %s(m %s, key %s) %s {
+	value, ok := m[key]
+	if !ok {
+		panic(%s.Errorf("map has no entry for key %%q", key))
+	}
+	return value
+}`, name, t.typeName(typ), t.typeName(m.Key()), t.typeName(m.Elem()), t.importPackage("fmt")))
+		t.mapIndexFunctions.Set(typ, name)
+	}
+	return name
+}
+
 func (t *Translator) getFunction(ident string) (*types.Signature, string, error) {
 	if f, ok := t.Funcs[ident]; ok {
-		pkgName := t.importPackage(f.Pkg().Path())
-		return f.Type().(*types.Signature), fmt.Sprintf("%s.%s", pkgName, f.Name()), nil
-	} else if f, ok := builtinFuncs[ident]; ok {
-		pkgName := t.importPackage(f.Pkg().Path())
-		return f.Type().(*types.Signature), fmt.Sprintf("%s.%s", pkgName, f.Name()), nil
+		return f.Type().(*types.Signature), t.qualify(f.Pkg()) + f.Name(), nil
+	} else if f, ok := t.builtins[ident]; ok {
+		return f.Type().(*types.Signature), t.qualify(f.Pkg()) + f.Name(), nil
 	} else {
 		return nil, "", fmt.Errorf("unknown function %s", ident)
 	}
@@ -638,6 +1321,11 @@ func (t *Translator) translateFunction(w io.Writer, dot types.Type, ident *parse
 		return nil, err
 	}
 
+	withContext := internal.TakesContext(typ)
+	if withContext && !t.Context {
+		return nil, fmt.Errorf("function %s takes a context.Context, which requires Context to be enabled", ident.Ident)
+	}
+
 	numOut := typ.Results().Len()
 
 	if numOut == 2 {
@@ -648,7 +1336,7 @@ func (t *Translator) translateFunction(w io.Writer, dot types.Type, ident *parse
 
 	io.WriteString(w, fName)
 
-	if err := t.translateCall(w, dot, args, nextCommands); err != nil {
+	if err := t.translateCall(w, dot, ident.Ident, typ, withContext, args, nextCommands); err != nil {
 		return nil, err
 	}
 
@@ -684,9 +1372,9 @@ func (t *Translator) translateFieldChain(w io.Writer, dot types.Type, dotCode io
 
 			var err error
 			if i == len(fields)-1 {
-				err = t.translateCall(&buf, dot, args, nextCommands)
+				err = t.translateCall(&buf, dot, name, sig, false, args, nextCommands)
 			} else {
-				err = t.translateCall(&buf, dot, nil, nil)
+				err = t.translateCall(&buf, dot, name, sig, false, nil, nil)
 			}
 			if err != nil {
 				return nil, err
@@ -699,6 +1387,18 @@ func (t *Translator) translateFieldChain(w io.Writer, dot types.Type, dotCode io
 			fmt.Fprintf(&buf, ".%s", name)
 			typ = obj.Type()
 		default:
+			if m, ok := typ.Underlying().(*types.Map); ok {
+				if key, ok := m.Key().Underlying().(*types.Basic); ok && key.Info()&types.IsString != 0 {
+					if t.MissingKey == "error" {
+						guards = append(guards, fmt.Sprintf("%s(", t.generateMapIndexFunction(typ)))
+						fmt.Fprintf(&buf, ", %q)", name)
+					} else {
+						fmt.Fprintf(&buf, "[%q]", name)
+					}
+					typ = m.Elem()
+					continue
+				}
+			}
 			return nil, fmt.Errorf("unknown field %s for type %s", name, typ.String())
 		}
 	}
@@ -713,22 +1413,19 @@ func (t *Translator) translateFieldChain(w io.Writer, dot types.Type, dotCode io
 	return typ, err
 }
 
-func (t *Translator) typeName(typ types.Type) string {
-	switch obj := typ.(type) {
-	case *types.Array:
-		return fmt.Sprintf("[%d]%s", obj.Len(), t.typeName(obj.Elem()))
-	case *types.Chan:
-		return fmt.Sprintf("chan %s", t.typeName(obj.Elem()))
-	case *types.Map:
-		return fmt.Sprintf("map[%s]%s", t.typeName(obj.Key()), t.typeName(obj.Elem()))
-	case *types.Named:
-		name := obj.Obj()
-		return t.importPackage(name.Pkg().Path()) + "." + name.Name()
-	case *types.Pointer:
-		return fmt.Sprintf("*%s", t.typeName(obj.Elem()))
-	case *types.Slice:
-		return fmt.Sprintf("[]%s", t.typeName(obj.Elem()))
-	default:
-		return typ.String()
+// qualify returns the prefix to refer to names in pkg, importing it if needed
+func (t *Translator) qualify(pkg *types.Package) string {
+	if pkg.Path() == t.PackagePath {
+		return ""
 	}
+	return t.importPackage(pkg.Path()) + "."
+}
+
+func (t *Translator) typeName(typ types.Type) string {
+	return types.TypeString(typ, func(pkg *types.Package) string {
+		if pkg.Path() == t.PackagePath {
+			return ""
+		}
+		return t.importPackage(pkg.Path())
+	})
 }
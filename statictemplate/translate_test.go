@@ -1,8 +1,12 @@
 package statictemplate
 
 import (
+	"github.com/stretchr/testify/assert"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
 	"go/types"
-	"gopkg.in/stretchr/testify.v1/assert"
 	"strings"
 	"testing"
 	"text/template"
@@ -61,8 +65,7 @@ func Name(w io.Writer, dot string) (err error) {
 
 // template.tmpl(string)
 func fun0(w io.Writer, dot string) error {
-  _, _ = io.WriteString(w, "hi")
-  _, _ = io.WriteString(w, "there")
+  _, _ = io.WriteString(w, "hithere")
   return nil
 }`},
 		{`{{ "hi" }}`, `
@@ -92,6 +95,30 @@ func fun0(w io.Writer, dot string) error {
 		{`{{ print ( "hi" | print ) }}`, `
 package main
 
+import (
+  "io"
+)
+
+func Name(w io.Writer, dot string) (err error) {
+  defer func() {
+    if recovered := recover(); recovered != nil {
+      var ok bool
+      if err, ok = recovered.(error); !ok {
+        panic(recovered)
+      }
+    }
+  }()
+  return fun0(w, dot)
+}
+
+// template.tmpl(string)
+func fun0(w io.Writer, dot string) error {
+  _, _ = io.WriteString(w, "hi")
+  return nil
+}`},
+		{`{{ print ( . | print ) }}`, `
+package main
+
 import (
   "bou.ke/statictemplate/funcs"
   "io"
@@ -111,7 +138,7 @@ func Name(w io.Writer, dot string) (err error) {
 
 // template.tmpl(string)
 func fun0(w io.Writer, dot string) error {
-  _, _ = io.WriteString(w, funcs.Print(funcs.Print("hi")))
+  _, _ = io.WriteString(w, funcs.Print(funcs.Print(dot)))
   return nil
 }`},
 		{`{{ printf "%d" (or 0 1) }}`, `
@@ -143,7 +170,6 @@ func fun0(w io.Writer, dot string) error {
 package main
 
 import (
-  "fmt"
   "io"
 )
 
@@ -161,7 +187,7 @@ func Name(w io.Writer, dot string) (err error) {
 
 // template.tmpl(string)
 func fun0(w io.Writer, dot string) error {
-  _, _ = fmt.Fprint(w, 1)
+  _, _ = io.WriteString(w, "1")
   return nil
 }`},
 		{`{{ . }}`, `
@@ -192,7 +218,6 @@ func fun0(w io.Writer, dot string) error {
 package main
 
 import (
-  "fmt"
   "io"
 )
 
@@ -210,14 +235,13 @@ func Name(w io.Writer, dot string) (err error) {
 
 // template.tmpl(string)
 func fun0(w io.Writer, dot string) error {
-  _, _ = fmt.Fprint(w, true)
+  _, _ = io.WriteString(w, "true")
   return nil
 }`},
 		{`{{ false }}`, `
 package main
 
 import (
-  "fmt"
   "io"
 )
 
@@ -235,15 +259,15 @@ func Name(w io.Writer, dot string) (err error) {
 
 // template.tmpl(string)
 func fun0(w io.Writer, dot string) error {
-  _, _ = fmt.Fprint(w, false)
+  _, _ = io.WriteString(w, "false")
   return nil
 }`},
 		{`{{ $a := 1 }}{{ $a }}`, `
 package main
 
 import (
-  "fmt"
   "io"
+  "strconv"
 )
 
 func Name(w io.Writer, dot string) (err error) {
@@ -260,9 +284,10 @@ func Name(w io.Writer, dot string) (err error) {
 
 // template.tmpl(string)
 func fun0(w io.Writer, dot string) error {
+  var scratch [32]byte
   _Vara := 1
 	_ = _Vara
-  _, _ = fmt.Fprint(w, _Vara)
+  _, _ = w.Write(strconv.AppendInt(scratch[:0], int64(_Vara), 10))
   return nil
 }`},
 		{`{{ $a := "hey" }}{{ $a }}`, `
@@ -350,6 +375,30 @@ func fun0(w io.Writer, dot string) error {
 		{`{{ "hi" | print }}`, `
 package main
 
+import (
+  "io"
+)
+
+func Name(w io.Writer, dot string) (err error) {
+  defer func() {
+    if recovered := recover(); recovered != nil {
+      var ok bool
+      if err, ok = recovered.(error); !ok {
+        panic(recovered)
+      }
+    }
+  }()
+  return fun0(w, dot)
+}
+
+// template.tmpl(string)
+func fun0(w io.Writer, dot string) error {
+  _, _ = io.WriteString(w, "hi")
+  return nil
+}`},
+		{`{{ . | print }}`, `
+package main
+
 import (
   "bou.ke/statictemplate/funcs"
   "io"
@@ -369,12 +418,36 @@ func Name(w io.Writer, dot string) (err error) {
 
 // template.tmpl(string)
 func fun0(w io.Writer, dot string) error {
-  _, _ = io.WriteString(w, funcs.Print("hi"))
+  _, _ = io.WriteString(w, funcs.Print(dot))
   return nil
 }`},
 		{`{{ ( "hi" | printf "%v" ) | print }}`, `
 package main
 
+import (
+  "io"
+)
+
+func Name(w io.Writer, dot string) (err error) {
+  defer func() {
+    if recovered := recover(); recovered != nil {
+      var ok bool
+      if err, ok = recovered.(error); !ok {
+        panic(recovered)
+      }
+    }
+  }()
+  return fun0(w, dot)
+}
+
+// template.tmpl(string)
+func fun0(w io.Writer, dot string) error {
+  _, _ = io.WriteString(w, "hi")
+  return nil
+}`},
+		{`{{ ( . | printf "%v" ) | print }}`, `
+package main
+
 import (
   "bou.ke/statictemplate/funcs"
   "io"
@@ -394,12 +467,36 @@ func Name(w io.Writer, dot string) (err error) {
 
 // template.tmpl(string)
 func fun0(w io.Writer, dot string) error {
-  _, _ = io.WriteString(w, funcs.Print(funcs.Printf("%v", "hi")))
+  _, _ = io.WriteString(w, funcs.Print(funcs.Printf("%v", dot)))
   return nil
 }`},
 		{`{{ ( "hi" | print ) | printf "%v" }}`, `
 package main
 
+import (
+  "io"
+)
+
+func Name(w io.Writer, dot string) (err error) {
+  defer func() {
+    if recovered := recover(); recovered != nil {
+      var ok bool
+      if err, ok = recovered.(error); !ok {
+        panic(recovered)
+      }
+    }
+  }()
+  return fun0(w, dot)
+}
+
+// template.tmpl(string)
+func fun0(w io.Writer, dot string) error {
+  _, _ = io.WriteString(w, "hi")
+  return nil
+}`},
+		{`{{ ( . | print ) | printf "%v" }}`, `
+package main
+
 import (
   "bou.ke/statictemplate/funcs"
   "io"
@@ -419,12 +516,36 @@ func Name(w io.Writer, dot string) (err error) {
 
 // template.tmpl(string)
 func fun0(w io.Writer, dot string) error {
-  _, _ = io.WriteString(w, funcs.Printf("%v", funcs.Print("hi")))
+  _, _ = io.WriteString(w, funcs.Printf("%v", funcs.Print(dot)))
   return nil
 }`},
 		{`{{ "hi" | print | print }}`, `
 package main
 
+import (
+  "io"
+)
+
+func Name(w io.Writer, dot string) (err error) {
+  defer func() {
+    if recovered := recover(); recovered != nil {
+      var ok bool
+      if err, ok = recovered.(error); !ok {
+        panic(recovered)
+      }
+    }
+  }()
+  return fun0(w, dot)
+}
+
+// template.tmpl(string)
+func fun0(w io.Writer, dot string) error {
+  _, _ = io.WriteString(w, "hi")
+  return nil
+}`},
+		{`{{ . | print | print }}`, `
+package main
+
 import (
   "bou.ke/statictemplate/funcs"
   "io"
@@ -444,12 +565,36 @@ func Name(w io.Writer, dot string) (err error) {
 
 // template.tmpl(string)
 func fun0(w io.Writer, dot string) error {
-  _, _ = io.WriteString(w, funcs.Print(funcs.Print("hi")))
+  _, _ = io.WriteString(w, funcs.Print(funcs.Print(dot)))
   return nil
 }`},
 		{`{{ "<wow>" | html }}`, `
 package main
 
+import (
+  "io"
+)
+
+func Name(w io.Writer, dot string) (err error) {
+  defer func() {
+    if recovered := recover(); recovered != nil {
+      var ok bool
+      if err, ok = recovered.(error); !ok {
+        panic(recovered)
+      }
+    }
+  }()
+  return fun0(w, dot)
+}
+
+// template.tmpl(string)
+func fun0(w io.Writer, dot string) error {
+  _, _ = io.WriteString(w, "&lt;wow&gt;")
+  return nil
+}`},
+		{`{{ . | html }}`, `
+package main
+
 import (
   "bou.ke/statictemplate/funcs"
   "io"
@@ -469,7 +614,7 @@ func Name(w io.Writer, dot string) (err error) {
 
 // template.tmpl(string)
 func fun0(w io.Writer, dot string) error {
-  _, _ = io.WriteString(w, funcs.Html("<wow>"))
+  _, _ = io.WriteString(w, funcs.Html(dot))
   return nil
 }`},
 		{`{{ if true }}a{{end}}`, `
@@ -548,9 +693,39 @@ func Name(w io.Writer, dot string) (err error) {
   return fun0(w, dot)
 }
 
+// template.tmpl(string)
+func fun0(w io.Writer, dot string) error {
+  _, _ = io.WriteString(w, "\n\n\nONE TWO ONE")
+  return nil
+}`},
+		{`{{define "T1"}}ONE{{if .}}!{{end}}{{end}}
+{{define "T2"}}TWO {{template "T1"}}{{end}}
+{{define "T3"}}{{template "T1"}} {{template "T2"}}{{end}}
+{{template "T3"}}`, `
+package main
+
+import (
+  "io"
+)
+
+func Name(w io.Writer, dot string) (err error) {
+  defer func() {
+    if recovered := recover(); recovered != nil {
+      var ok bool
+      if err, ok = recovered.(error); !ok {
+        panic(recovered)
+      }
+    }
+  }()
+  return fun0(w, dot)
+}
+
 // T1(nil)
 func fun2(w io.Writer, dot interface{}) error {
   _, _ = io.WriteString(w, "ONE")
+  if eval := dot; eval != nil {
+    _, _ = io.WriteString(w, "!")
+  }
   return nil
 }
 
@@ -577,9 +752,7 @@ func fun1(w io.Writer, dot interface{}) error {
 
 // template.tmpl(string)
 func fun0(w io.Writer, dot string) error {
-  _, _ = io.WriteString(w, "\n")
-  _, _ = io.WriteString(w, "\n")
-  _, _ = io.WriteString(w, "\n")
+  _, _ = io.WriteString(w, "\n\n\n")
   if err := fun1(w, nil); err != nil {
     return err
   }
@@ -634,8 +807,7 @@ func fun1(w io.Writer, dot interface{}) error {
 
 // template.tmpl(string)
 func fun0(w io.Writer, dot string) error {
-  _, _ = io.WriteString(w, "\n")
-  _, _ = io.WriteString(w, "\n")
+  _, _ = io.WriteString(w, "\n\n")
   if err := fun1(w, nil); err != nil {
     return err
   }
@@ -651,3 +823,62 @@ func fun0(w io.Writer, dot string) error {
 		}
 	}
 }
+
+func TestTranslateTypeChecks(t *testing.T) {
+	for _, input := range []string{
+		`{{ $a := 1 }}{{ $a }}`,
+		`{{ $a := 2.0 }}{{ $a }}`,
+		`{{ $a := 1e3 }}{{ $a }}{{ 0x10 }}{{ 'a' }}`,
+		`{{ $a := 1 }}{{ range $i, $b := . }}{{ $a }}{{ $i }}{{ end }}`,
+	} {
+		temp := template.Must(template.New("template.tmpl").Parse(input))
+		actual, err := Translate(temp, "main", []TranslateInstruction{
+			{"Name", "template.tmpl", types.NewSlice(types.Typ[types.String])},
+		})
+		if !assert.NoError(t, err, input) {
+			continue
+		}
+		// The generated code only imports packages from the standard library
+		fset := token.NewFileSet()
+		file, err := parser.ParseFile(fset, "template.go", actual, 0)
+		if assert.NoError(t, err, input) {
+			config := types.Config{Importer: importer.ForCompiler(fset, "source", nil)}
+			_, err = config.Check("main", fset, []*ast.File{file}, nil)
+			assert.NoError(t, err, input)
+		}
+	}
+}
+
+func TestRangeMapKeys(t *testing.T) {
+	for _, c := range []struct {
+		key  types.Type
+		less string
+	}{
+		{types.Typ[types.Bool], "!entries[i].key && entries[j].key"},
+		{types.Typ[types.Uintptr], "entries[i].key < entries[j].key"},
+		{types.Typ[types.Float64], "entries[i].key < entries[j].key || entries[i].key != entries[i].key && entries[j].key == entries[j].key"},
+		{types.Typ[types.Complex64], "real(entries[i].key) < real(entries[j].key) || real(entries[i].key) != real(entries[i].key) && real(entries[j].key) == real(entries[j].key) || (real(entries[i].key) == real(entries[j].key) || real(entries[i].key) != real(entries[i].key) && real(entries[j].key) != real(entries[j].key)) && (imag(entries[i].key) < imag(entries[j].key) || imag(entries[i].key) != imag(entries[i].key) && imag(entries[j].key) == imag(entries[j].key))"},
+	} {
+		temp := template.Must(template.New("template.tmpl").Parse(`{{ range $k, $v := . }}{{ $k }}{{ $v }}{{ end }}`))
+		actual, err := Translate(temp, "main", []TranslateInstruction{
+			{"Name", "template.tmpl", types.NewMap(c.key, types.Typ[types.String])},
+		})
+		if !assert.NoError(t, err, c.key.String()) {
+			continue
+		}
+		assert.Contains(t, string(actual), "return "+c.less, c.key.String())
+		fset := token.NewFileSet()
+		file, err := parser.ParseFile(fset, "template.go", actual, 0)
+		if assert.NoError(t, err, c.key.String()) {
+			config := types.Config{Importer: importer.ForCompiler(fset, "source", nil)}
+			_, err = config.Check("main", fset, []*ast.File{file}, nil)
+			assert.NoError(t, err, c.key.String())
+		}
+	}
+
+	temp := template.Must(template.New("template.tmpl").Parse(`{{ range . }}{{ . }}{{ end }}`))
+	_, err := Translate(temp, "main", []TranslateInstruction{
+		{"Name", "template.tmpl", types.NewMap(types.NewArray(types.Typ[types.Int], 2), types.Typ[types.String])},
+	})
+	assert.EqualError(t, err, "template.tmpl:1:10: range over map with unsupported key type [2]int")
+}
@@ -5,7 +5,7 @@ import (
 	"testing"
 	"text/template"
 
-	"gopkg.in/stretchr/testify.v1/assert"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestComplexInput(t *testing.T) {
@@ -127,8 +127,8 @@ func fun0(w io.Writer, dot []string) error {
 package main
 
 import (
-  "fmt"
   "io"
+  "strconv"
 )
 
 func Name(w io.Writer, dot []string) (err error) {
@@ -145,12 +145,13 @@ func Name(w io.Writer, dot []string) (err error) {
 
 // template.tmpl([]string)
 func fun0(w io.Writer, dot []string) error {
+  var scratch [32]byte
   if eval := dot; len(eval) != 0 {
     for _Vari, _Vara := range eval {
 			_ = _Vari
 			dot := _Vara
 			_ = dot
-      _, _ = fmt.Fprint(w, _Vari)
+      _, _ = w.Write(strconv.AppendInt(scratch[:0], int64(_Vari), 10))
       _, _ = io.WriteString(w, _Vara)
     }
   }
@@ -294,7 +295,11 @@ func fun0(w io.Writer, dot struct{ A bool }) error {
     _, _ = io.WriteString(w, " ")
   } else {
     _, _ = io.WriteString(w, " ")
-    _, _ = fmt.Fprint(w, dot.A)
+    if dot.A {
+      _, _ = io.WriteString(w, "true")
+    } else {
+      _, _ = io.WriteString(w, "false")
+    }
     _, _ = io.WriteString(w, " ")
   }
   return nil
@@ -544,8 +549,8 @@ package main
 
 import (
   pkg1 "bou.ke/statictemplate/statictemplate"
-  "fmt"
   "io"
+  "strconv"
 )
 
 func Name(w io.Writer, dot pkg1.testStruct) (err error) {
@@ -569,7 +574,8 @@ func fun2(value int, err error) int {
 
 // template.tmpl(pkg1.testStruct)
 func fun0(w io.Writer, dot pkg1.testStruct) error {
-  _, _ = fmt.Fprint(w, fun2(dot.Bla()))
+  var scratch [32]byte
+  _, _ = w.Write(strconv.AppendInt(scratch[:0], int64(fun2(dot.Bla())), 10))
   return nil
 }
 `, testStruct},
@@ -632,14 +638,54 @@ func fun2(w io.Writer, dot *pkg1.testStruct) error {
 
 // template.tmpl(*pkg1.testStruct)
 func fun0(w io.Writer, dot *pkg1.testStruct) error {
-  _, _ = io.WriteString(w, "\n")
-  _, _ = io.WriteString(w, "\n")
-  _, _ = io.WriteString(w, "\n")
+  _, _ = io.WriteString(w, "\n\n\n")
   if err := fun2(w, dot); err != nil {
     return err
   }
   return nil
 }`, types.NewPointer(testStruct)},
+		{`{{ range $k, $v := . }}{{ $k }}{{ end }}{{ .a }}`, `
+package main
+
+import (
+  "io"
+  "sort"
+)
+
+func Name(w io.Writer, dot map[string]string) (err error) {
+  defer func() {
+    if recovered := recover(); recovered != nil {
+      var ok bool
+      if err, ok = recovered.(error); !ok {
+        panic(recovered)
+      }
+    }
+  }()
+  return fun0(w, dot)
+}
+
+// template.tmpl(map[string]string)
+func fun0(w io.Writer, dot map[string]string) error {
+  if eval := dot; len(eval) != 0 {
+    type entry struct {
+      key   string
+      value string
+    }
+    entries := make([]entry, 0, len(eval))
+    for key, value := range eval {
+      entries = append(entries, entry{key, value})
+    }
+    sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+    for _, e := range entries {
+      _Vark, _Varv := e.key, e.value
+      dot := _Varv
+      _ = dot
+      _, _ = io.WriteString(w, _Vark)
+    }
+  }
+  _, _ = io.WriteString(w, dot["a"])
+  return nil
+}`, types.NewMap(types.Typ[types.String], types.Typ[types.String])},
 	} {
 		temp := template.Must(template.New("template.tmpl").Parse(c.input))
 		actual, err := Translate(temp, "main", []TranslateInstruction{
@@ -650,3 +696,62 @@ func fun0(w io.Writer, dot *pkg1.testStruct) error {
 		}
 	}
 }
+
+func TestMissingKeyError(t *testing.T) {
+	temp := template.Must(template.New("template.tmpl").Parse(`{{ .a.b }}`))
+	translator := New(temp)
+	translator.MissingKey = "error"
+	actual, err := translator.Translate("main", []TranslateInstruction{
+		{"Name", "template.tmpl", types.NewMap(types.Typ[types.String], types.NewMap(types.Typ[types.String], types.Typ[types.String]))},
+	})
+	if assert.NoError(t, err) {
+		equalish(t, `
+package main
+
+import (
+  "fmt"
+  "io"
+)
+
+func Name(w io.Writer, dot map[string]map[string]string) (err error) {
+  defer func() {
+    if recovered := recover(); recovered != nil {
+      var ok bool
+      if err, ok = recovered.(error); !ok {
+        panic(recovered)
+      }
+    }
+  }()
+  return fun0(w, dot)
+}
+
+func fun1(m map[string]map[string]string, key string) map[string]string {
+  value, ok := m[key]
+  if !ok {
+    panic(fmt.Errorf("map has no entry for key %q", key))
+  }
+  return value
+}
+
+func fun2(m map[string]string, key string) string {
+  value, ok := m[key]
+  if !ok {
+    panic(fmt.Errorf("map has no entry for key %q", key))
+  }
+  return value
+}
+
+// template.tmpl(map[string]map[string]string)
+func fun0(w io.Writer, dot map[string]map[string]string) error {
+  _, _ = io.WriteString(w, fun2(fun1(dot, "a"), "b"))
+  return nil
+}`, actual, "{{ .a.b }}")
+	}
+
+	translator = New(temp)
+	translator.MissingKey = "default"
+	_, err = translator.Translate("main", []TranslateInstruction{
+		{"Name", "template.tmpl", types.NewMap(types.Typ[types.String], types.Typ[types.String])},
+	})
+	assert.EqualError(t, err, `unsupported missingkey option "default", expected zero or error`)
+}
@@ -0,0 +1,212 @@
+package statictemplate
+
+import (
+	"go/types"
+	"testing"
+	"text/template"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStringAndAppend(t *testing.T) {
+	temp := template.Must(template.New("index.tmpl").Parse(`{{ .A }}:{{ range .B }}<{{ . }}>{{ end }}`))
+	translator := New(temp)
+	translator.String = true
+	translator.Append = true
+	dot := types.NewStruct([]*types.Var{
+		types.NewVar(0, nil, "A", types.Typ[types.String]),
+		types.NewVar(0, nil, "B", types.NewSlice(types.Typ[types.Int])),
+	}, nil)
+	actual, err := translator.Translate("main", []TranslateInstruction{
+		{"Index", "index.tmpl", dot},
+	})
+	if assert.NoError(t, err) {
+		equalish(t, `
+package main
+
+import (
+  "io"
+  "strconv"
+)
+
+func Index(w io.Writer, dot struct {
+  A string
+  B []int
+}) (err error) {
+  defer func() {
+    if recovered := recover(); recovered != nil {
+      var ok bool
+      if err, ok = recovered.(error); !ok {
+        panic(recovered)
+      }
+    }
+  }()
+  return fun0(w, dot)
+}
+
+func IndexString(dot struct {
+  A string
+  B []int
+}) (s string, err error) {
+  defer func() {
+    if recovered := recover(); recovered != nil {
+      var ok bool
+      if err, ok = recovered.(error); !ok {
+        panic(recovered)
+      }
+    }
+  }()
+  var b []byte
+  err = fun1(&b, dot)
+  return string(b), err
+}
+
+func IndexAppend(dst []byte, dot struct {
+  A string
+  B []int
+}) (b []byte, err error) {
+  defer func() {
+    if recovered := recover(); recovered != nil {
+      var ok bool
+      if err, ok = recovered.(error); !ok {
+        panic(recovered)
+      }
+    }
+  }()
+  b = dst
+  err = fun1(&b, dot)
+  return b, err
+}
+
+// index.tmpl(struct{A string; B []int})
+func fun0(w io.Writer, dot struct {
+  A string
+  B []int
+}) error {
+  var scratch [32]byte
+  _, _ = io.WriteString(w, dot.A)
+  _, _ = io.WriteString(w, ":")
+  if eval := dot.B; len(eval) != 0 {
+    for _, dot := range eval {
+      _ = dot
+      _, _ = io.WriteString(w, "<")
+      _, _ = w.Write(strconv.AppendInt(scratch[:0], int64(dot), 10))
+      _, _ = io.WriteString(w, ">")
+    }
+  }
+  return nil
+}
+
+// index.tmpl(struct{A string; B []int}, appending)
+func fun1(w *[]byte, dot struct {
+  A string
+  B []int
+}) error {
+  *w = append(*w, dot.A...)
+  *w = append(*w, ":"...)
+  if eval := dot.B; len(eval) != 0 {
+    for _, dot := range eval {
+      _ = dot
+      *w = append(*w, "<"...)
+      *w = strconv.AppendInt(*w, int64(dot), 10)
+      *w = append(*w, ">"...)
+    }
+  }
+  return nil
+}`, actual, "string and append")
+	}
+}
+
+func TestSizes(t *testing.T) {
+	temp := template.Must(template.New("index.tmpl").Parse(`<p>{{ . }}</p>`))
+	translator := New(temp)
+	translator.String = true
+	translator.Append = true
+	translator.Sizes = true
+	translator.AverageSizes = map[string]int{"Index": 64}
+	actual, err := translator.Translate("main", []TranslateInstruction{
+		{"Index", "index.tmpl", types.Typ[types.String]},
+	})
+	if assert.NoError(t, err) {
+		equalish(t, `
+package main
+
+import (
+  "io"
+)
+
+func Index(w io.Writer, dot string) (err error) {
+  defer func() {
+    if recovered := recover(); recovered != nil {
+      var ok bool
+      if err, ok = recovered.(error); !ok {
+        panic(recovered)
+      }
+    }
+  }()
+  return fun0(w, dot)
+}
+
+const IndexMinSize = 7
+
+const IndexAverageSize = 64
+
+func IndexString(dot string) (s string, err error) {
+  defer func() {
+    if recovered := recover(); recovered != nil {
+      var ok bool
+      if err, ok = recovered.(error); !ok {
+        panic(recovered)
+      }
+    }
+  }()
+  b := make([]byte, 0, IndexAverageSize)
+  err = fun1(&b, dot)
+  return string(b), err
+}
+
+func IndexAppend(dst []byte, dot string) (b []byte, err error) {
+  defer func() {
+    if recovered := recover(); recovered != nil {
+      var ok bool
+      if err, ok = recovered.(error); !ok {
+        panic(recovered)
+      }
+    }
+  }()
+  b = dst
+  if cap(b)-len(b) < IndexAverageSize {
+    b = append(make([]byte, 0, len(b)+IndexAverageSize), b...)
+  }
+  err = fun1(&b, dot)
+  return b, err
+}
+
+// index.tmpl(string)
+func fun0(w io.Writer, dot string) error {
+  _, _ = io.WriteString(w, "<p>")
+  _, _ = io.WriteString(w, dot)
+  _, _ = io.WriteString(w, "</p>")
+  return nil
+}
+
+// index.tmpl(string, appending)
+func fun1(w *[]byte, dot string) error {
+  *w = append(*w, "<p>"...)
+  *w = append(*w, dot...)
+  *w = append(*w, "</p>"...)
+  return nil
+}`, actual, "sizes")
+	}
+}
+
+func TestAverageSizesUnknownFunction(t *testing.T) {
+	temp := template.Must(template.New("index.tmpl").Parse(`<p>{{ . }}</p>`))
+	translator := New(temp)
+	translator.Sizes = true
+	translator.AverageSizes = map[string]int{"Idnex": 48213}
+	_, err := translator.Translate("main", []TranslateInstruction{
+		{"Index", "index.tmpl", types.Typ[types.String]},
+	})
+	assert.EqualError(t, err, "average size given for Idnex, which isn't a generated function")
+}
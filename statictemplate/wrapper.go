@@ -1,6 +1,7 @@
 package statictemplate
 
 import (
+	"fmt"
 	htmlTemplate "html/template"
 	textTemplate "text/template"
 	"text/template/parse"
@@ -24,7 +25,11 @@ func (t textTemplateWrapper) Tree() *parse.Tree {
 }
 
 func (t textTemplateWrapper) Lookup(name string) (wrappedTemplate, error) {
-	return textTemplateWrapper{t.Template.Lookup(name)}, nil
+	temp := t.Template.Lookup(name)
+	if temp == nil || temp.Tree == nil {
+		return nil, fmt.Errorf("template: no such template %q", name)
+	}
+	return textTemplateWrapper{temp}, nil
 }
 
 type htmlTemplateWrapper struct {
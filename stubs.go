@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/types"
+	"io"
+	"strings"
+
+	"bou.ke/statictemplate/internal"
+	"golang.org/x/tools/go/packages"
+)
+
+const (
+	stubDirective = "//statictemplate:template "
+	// stubBuildTag excludes files with bodyless stub functions from the normal build
+	stubBuildTag = "statictemplate"
+)
+
+// checkStubErrors returns the first error of the stubs package that isn't about
+// the stubs not having a body, which the generated code provides
+func checkStubErrors(pkg *packages.Package) error {
+	for _, err := range pkg.Errors {
+		if !isMissingBodyError(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func isMissingBodyError(err packages.Error) bool {
+	for _, line := range strings.Split(err.Msg, "\n") {
+		if !strings.HasPrefix(line, "#") && !strings.HasSuffix(line, "missing function body") {
+			return false
+		}
+	}
+	return true
+}
+
+// stubTargets finds the declarations annotated with a //statictemplate:template directive, like
+//
+//	//statictemplate:template index.tmpl
+//	func Index(w io.Writer, posts []example.Post) error
+//
+// or
+//
+//	//statictemplate:template index.tmpl
+//	var Index func(w io.Writer, posts []example.Post) error
+//
+// and returns the targets they declare. withContext reports whether the stubs take a context.Context.
+func stubTargets(pkg *packages.Package) (stubs compilationTargets, withContext bool, err error) {
+	var contextStubs int
+	add := func(name *ast.Ident, doc *ast.CommentGroup, isVar bool) error {
+		templateName, ok := stubTemplateName(doc)
+		if !ok {
+			return nil
+		}
+		position := pkg.Fset.Position(name.Pos())
+		obj := pkg.TypesInfo.Defs[name]
+		sig, ok := obj.Type().Underlying().(*types.Signature)
+		if !ok {
+			return fmt.Errorf("%s: %s must be a function", position, name.Name)
+		}
+		dot, takesContext, err := stubDot(sig)
+		if err != nil {
+			return fmt.Errorf("%s: %s: %v", position, name.Name, err)
+		}
+		if takesContext {
+			contextStubs++
+		}
+
+		dotExpr, err := internal.ParseTypeExpr(types.TypeString(dot, (*types.Package).Path))
+		if err != nil {
+			return err
+		}
+		target := compilationTarget{
+			functionName: name.Name,
+			templateName: templateName,
+			dot:          dotExpr,
+			typ:          dot,
+		}
+		if isVar {
+			target.functionName = "statictemplate" + name.Name
+			target.assign = name.Name
+		}
+		stubs = append(stubs, target)
+		return nil
+	}
+
+	for _, file := range pkg.Syntax {
+		for _, decl := range file.Decls {
+			switch decl := decl.(type) {
+			case *ast.FuncDecl:
+				if decl.Recv != nil {
+					continue
+				}
+				if _, ok := stubTemplateName(decl.Doc); ok && decl.Body != nil {
+					return nil, false, fmt.Errorf("%s: stub %s can't have a body", pkg.Fset.Position(decl.Pos()), decl.Name.Name)
+				}
+				err = add(decl.Name, decl.Doc, false)
+			case *ast.GenDecl:
+				for _, spec := range decl.Specs {
+					spec, ok := spec.(*ast.ValueSpec)
+					if !ok {
+						continue
+					}
+					doc := spec.Doc
+					if doc == nil && len(decl.Specs) == 1 {
+						doc = decl.Doc
+					}
+					for _, name := range spec.Names {
+						if err := add(name, doc, true); err != nil {
+							return nil, false, err
+						}
+					}
+				}
+			}
+			if err != nil {
+				return nil, false, err
+			}
+		}
+	}
+	if contextStubs != 0 && contextStubs != len(stubs) {
+		return nil, false, fmt.Errorf("either all or none of the stubs in %s must take a context.Context", pkg.PkgPath)
+	}
+	return stubs, contextStubs != 0, nil
+}
+
+func stubTemplateName(doc *ast.CommentGroup) (string, bool) {
+	if doc == nil {
+		return "", false
+	}
+	for _, comment := range doc.List {
+		if strings.HasPrefix(comment.Text, stubDirective) {
+			return strings.TrimSpace(strings.TrimPrefix(comment.Text, stubDirective)), true
+		}
+	}
+	return "", false
+}
+
+// stubDot checks that the signature is func([context.Context,] io.Writer, T) error and returns T
+func stubDot(sig *types.Signature) (types.Type, bool, error) {
+	params := sig.Params()
+	takesContext := internal.TakesContext(sig)
+	offset := 0
+	if takesContext {
+		offset = 1
+	}
+	if params.Len() != offset+2 || !isNamed(params.At(offset).Type(), "io", "Writer") ||
+		sig.Results().Len() != 1 || !types.Identical(sig.Results().At(0).Type(), types.Universe.Lookup("error").Type()) || sig.Variadic() {
+		return nil, false, fmt.Errorf("expected signature func([context.Context,] io.Writer, T) error, got %s", sig)
+	}
+	return params.At(offset + 1).Type(), takesContext, nil
+}
+
+func isNamed(typ types.Type, pkgPath, name string) bool {
+	named, ok := typ.(*types.Named)
+	return ok && named.Obj().Pkg() != nil && named.Obj().Pkg().Path() == pkgPath && named.Obj().Name() == name
+}
+
+// writeStubAssignments assigns the generated functions to the stub variables they implement
+func writeStubAssignments(w io.Writer, targets compilationTargets) {
+	var assigned bool
+	for _, target := range targets {
+		if target.assign == "" {
+			continue
+		}
+		if !assigned {
+			io.WriteString(w, "\nfunc init() {\n")
+			assigned = true
+		}
+		fmt.Fprintf(w, "%s = %s\n", target.assign, target.functionName)
+	}
+	if assigned {
+		io.WriteString(w, "}\n")
+	}
+}
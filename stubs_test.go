@@ -0,0 +1,76 @@
+package main
+
+import (
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/tools/go/packages"
+)
+
+func checkStubs(t *testing.T, src string) *packages.Package {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "stubs.go", src, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := &types.Info{Defs: make(map[*ast.Ident]types.Object)}
+	conf := types.Config{Importer: importer.Default(), Error: func(error) {}}
+	pkg, _ := conf.Check("bou.ke/stubs", fset, []*ast.File{file}, info)
+	return &packages.Package{
+		PkgPath:   "bou.ke/stubs",
+		Fset:      fset,
+		Syntax:    []*ast.File{file},
+		Types:     pkg,
+		TypesInfo: info,
+	}
+}
+
+func TestStubTargets(t *testing.T) {
+	pkg := checkStubs(t, `package stubs
+
+import "io"
+
+type page struct{ Title string }
+
+//statictemplate:template index.tmpl
+func Index(w io.Writer, p []page) error
+
+// Post renders a post
+//statictemplate:template post.tmpl
+var Post func(io.Writer, string) error
+
+func unrelated(w io.Writer, s string) error { return nil }
+`)
+	stubs, withContext, err := stubTargets(pkg)
+	if assert.NoError(t, err) {
+		assert.False(t, withContext)
+		if assert.Len(t, stubs, 2) {
+			assert.Equal(t, "Index", stubs[0].functionName)
+			assert.Equal(t, "index.tmpl", stubs[0].templateName)
+			assert.Equal(t, "[]bou.ke/stubs.page", stubs[0].dot.Source)
+			assert.Equal(t, "", stubs[0].assign)
+
+			assert.Equal(t, "statictemplatePost", stubs[1].functionName)
+			assert.Equal(t, "post.tmpl", stubs[1].templateName)
+			assert.Equal(t, "string", stubs[1].typ.String())
+			assert.Equal(t, "Post", stubs[1].assign)
+		}
+	}
+}
+
+func TestStubTargetsError(t *testing.T) {
+	pkg := checkStubs(t, `package stubs
+
+import "io"
+
+//statictemplate:template index.tmpl
+func Index(w io.Writer, p string) string
+`)
+	_, _, err := stubTargets(pkg)
+	assert.EqualError(t, err, "stubs.go:6:6: Index: expected signature func([context.Context,] io.Writer, T) error, got func(w io.Writer, p string) string")
+}
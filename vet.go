@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"text/template/parse"
+
+	htmlTemplate "html/template"
+	textTemplate "text/template"
+
+	"bou.ke/statictemplate/internal"
+	"bou.ke/statictemplate/statictemplate"
+	"golang.org/x/tools/go/packages"
+)
+
+// parseErrorRe matches the errors returned by the template parser
+var parseErrorRe = regexp.MustCompile(`^template: (.*?):(\d+): ((?s).*)$`)
+
+var errProblems = errors.New("vet found problems in the templates")
+
+// diagnostic is a problem found by vet
+type diagnostic struct {
+	File    string `json:"file,omitempty"`
+	Line    int    `json:"line,omitempty"`
+	Column  int    `json:"column,omitempty"`
+	Message string `json:"message"`
+}
+
+func (d diagnostic) String() string {
+	switch {
+	case d.File == "":
+		return d.Message
+	case d.Column == 0:
+		return fmt.Sprintf("%s:%d: %s", d.File, d.Line, d.Message)
+	default:
+		return fmt.Sprintf("%s:%d:%d: %s", d.File, d.Line, d.Column, d.Message)
+	}
+}
+
+// vet type checks the targets of all groups and prints every problem it finds
+func vet(groups []*outputGroup, pkgs map[string]*packages.Package) error {
+	var diagnostics []diagnostic
+	for _, g := range groups {
+		d, err := g.vet(pkgs)
+		if err != nil {
+			return err
+		}
+		diagnostics = append(diagnostics, d...)
+	}
+
+	if jsonOutput {
+		if diagnostics == nil {
+			diagnostics = []diagnostic{}
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(diagnostics); err != nil {
+			return err
+		}
+	} else {
+		for _, d := range diagnostics {
+			fmt.Fprintln(os.Stderr, d)
+		}
+	}
+	if len(diagnostics) != 0 {
+		return errProblems
+	}
+	return nil
+}
+
+func (g *outputGroup) vet(pkgs map[string]*packages.Package) ([]diagnostic, error) {
+	var funcs map[string]*types.Func
+	if g.Funcs != "" {
+		funcMapImport, funcMapName, err := internal.ParseFuncMapReference(g.Funcs)
+		if err != nil {
+			return nil, err
+		}
+		if funcs, err = internal.FuncMap(pkgs[funcMapImport], funcMapName); err != nil {
+			return nil, err
+		}
+	}
+
+	options, err := g.parseOptions()
+	if err != nil {
+		return nil, err
+	}
+	template, errs, err := parseTemplatesForVet(g.HTML, g.Root, options, g.sources, g.templateFiles...)
+	if err != nil {
+		return nil, err
+	}
+	errs = append(g.discoveryErrors, errs...)
+
+	translator := statictemplate.New(template)
+	translator.Funcs = funcs
+	translator.Context = g.Context
+	translator.PackagePath = g.packagePath
+	translator.MissingKey = g.MissingKey
+	if translator.Implementations, err = g.implementations(pkgs); err != nil {
+		return nil, err
+	}
+	ins, err := g.targets.ToInstructions(pkgs)
+	if err != nil {
+		return nil, err
+	}
+	errs = append(errs, translator.Check(ins)...)
+
+	// Errors refer to the templates by the name of their file, or the name they
+	// were created with in Go source
+	files := make(map[string]string)
+	for _, file := range g.templateFiles {
+		files[templateName(g.Root, file)] = file
+	}
+	sources := make(map[string]sourceTemplate)
+	for _, source := range g.sources {
+		sources[source.name] = source
+	}
+	diagnostics := make([]diagnostic, 0, len(errs))
+	for _, err := range errs {
+		e, ok := err.(*statictemplate.Error)
+		if !ok {
+			diagnostics = append(diagnostics, diagnostic{Message: err.Error()})
+			continue
+		}
+		d := diagnostic{File: e.Template, Line: e.Line, Column: e.Column, Message: e.Err.Error()}
+		if file, ok := files[e.Template]; ok {
+			d.File = file
+		} else if source, ok := sources[e.Template]; ok {
+			d.File, d.Line, d.Column = source.position(e.Line, e.Column)
+		}
+		diagnostics = append(diagnostics, d)
+	}
+	return diagnostics, nil
+}
+
+// parseTemplatesForVet parses the files and source templates like generate does, but keeps
+// going after a template fails to parse. Unknown functions are left for the translator to report.
+func parseTemplatesForVet(html bool, root string, options statictemplate.ParseOptions, sources []sourceTemplate, files ...string) (interface{}, []error, error) {
+	textTemp := textTemplate.New("")
+	htmlTemp := htmlTemplate.New("")
+	var parseErrors []error
+	names := make([]string, 0, len(files)+len(sources))
+	texts := make([]string, 0, len(files)+len(sources))
+	delims := make([][2]string, 0, len(files)+len(sources))
+	for _, file := range files {
+		contents, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		names = append(names, templateName(root, file))
+		texts = append(texts, string(contents))
+		delims = append(delims, [2]string{options.LeftDelim, options.RightDelim})
+	}
+	for _, source := range sources {
+		names = append(names, source.name)
+		texts = append(texts, source.text)
+		delims = append(delims, [2]string{source.leftDelim, source.rightDelim})
+	}
+	for i, name := range names {
+		tree := parse.New(name)
+		tree.Mode = options.Mode | parse.SkipFuncCheck
+		treeSet := make(map[string]*parse.Tree)
+		if _, err := tree.Parse(texts[i], delims[i][0], delims[i][1], treeSet); err != nil {
+			parseErrors = append(parseErrors, parseError(err))
+			continue
+		}
+		for name, tree := range treeSet {
+			var err error
+			if html {
+				_, err = htmlTemp.AddParseTree(name, tree)
+			} else {
+				_, err = textTemp.AddParseTree(name, tree)
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	if html {
+		return htmlTemp, parseErrors, nil
+	}
+	return textTemp, parseErrors, nil
+}
+
+// parseError converts an error returned by the template parser to a *statictemplate.Error
+func parseError(err error) error {
+	m := parseErrorRe.FindStringSubmatch(err.Error())
+	if m == nil {
+		return err
+	}
+	line, _ := strconv.Atoi(m[2])
+	return &statictemplate.Error{Template: m[1], Line: line, Err: errors.New(m[3])}
+}
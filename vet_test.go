@@ -0,0 +1,44 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statictemplate")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	index := filepath.Join(dir, "index.tmpl")
+	broken := filepath.Join(dir, "broken.tmpl")
+	assert.NoError(t, ioutil.WriteFile(index, []byte(`{{/* statictemplate: func=Index dot=string */}}
+{{ .Title }}{{ frobnicate . }}
+{{ range . }}{{ end }}
+{{/* statictemplate: func=Broken */}}`), 0644))
+	assert.NoError(t, ioutil.WriteFile(broken, []byte("hello\n{{ if }}"), 0644))
+
+	vetOnly = true
+	defer func() { vetOnly = false }()
+	g := &outputGroup{Templates: []string{filepath.Join(dir, "*.tmpl")}}
+	if !assert.NoError(t, g.resolveTemplates()) || !assert.NoError(t, g.resolve()) {
+		return
+	}
+	diagnostics, err := g.vet(nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []diagnostic{
+			{File: index, Line: 4, Column: 3, Message: "annotation needs both func and dot"},
+			{File: broken, Line: 2, Message: "missing value for if"},
+			{File: index, Line: 2, Column: 4, Message: "unknown field Title for type string"},
+			{File: index, Line: 2, Column: 16, Message: "unknown function frobnicate"},
+			{File: index, Line: 3, Column: 10, Message: "range can't iterate over string"},
+		}, diagnostics)
+		assert.Equal(t, index+":2:4: unknown field Title for type string", diagnostics[2].String())
+		assert.Equal(t, broken+":2: missing value for if", diagnostics[1].String())
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/tools/go/packages"
+)
+
+const watchInterval = 500 * time.Millisecond
+
+// watcher regenerates the output when the templates or the Go packages it's generated from change
+type watcher struct {
+	config *config
+	pkgs   map[string]*packages.Package
+	// templates and goFiles are the modification times of the files the output was last generated from
+	templates map[string]time.Time
+	goFiles   map[string]time.Time
+	// goPaths are the files and directories of the loaded packages
+	goPaths []string
+}
+
+// watch keeps regenerating the output until the process is stopped. The loaded
+// packages are kept, and only reloaded when one of their files changes.
+func watch(c *config) {
+	w := &watcher{config: c}
+	w.update(true)
+	for {
+		time.Sleep(watchInterval)
+		w.poll()
+	}
+}
+
+func (w *watcher) poll() {
+	goChanged := !equalModTimes(modTimes(w.goPaths), w.goFiles)
+	if !goChanged && equalModTimes(w.templateModTimes(), w.templates) {
+		return
+	}
+	w.update(goChanged || w.pkgs == nil)
+}
+
+func (w *watcher) update(reload bool) {
+	w.templates = w.templateModTimes()
+	if err := w.regenerate(reload); err != nil {
+		log.Print(err)
+	} else {
+		log.Print("output is up to date")
+	}
+	// The output may be in one of the watched directories, so this has to happen after writing it
+	w.goFiles = modTimes(w.goPaths)
+}
+
+func (w *watcher) regenerate(reload bool) error {
+	if !reload {
+		// Changed templates can declare targets with types from packages that aren't loaded yet
+		for _, g := range w.config.Groups {
+			if err := g.resolveTemplates(); err != nil {
+				return err
+			}
+			if err := g.resolve(); err != nil {
+				return err
+			}
+		}
+		paths, err := w.config.packagePaths()
+		if err != nil {
+			return err
+		}
+		for _, path := range paths {
+			if _, ok := w.pkgs[path]; !ok {
+				reload = true
+			}
+		}
+	}
+	if reload {
+		w.pkgs = nil
+		pkgs, err := load(w.config)
+		if err != nil {
+			return err
+		}
+		w.pkgs = pkgs
+		w.goPaths = w.packagePaths()
+	}
+	return output(w.config, w.pkgs)
+}
+
+// packagePaths returns the Go files of the loaded, stubs and source packages, and their
+// directories to notice files being added or removed
+func (w *watcher) packagePaths() []string {
+	var files []string
+	for _, pkg := range w.pkgs {
+		files = append(files, pkg.GoFiles...)
+	}
+	for _, g := range w.config.Groups {
+		files = append(files, g.stubFiles...)
+		if g.sourcePackage != nil {
+			files = append(files, g.sourcePackage.GoFiles...)
+		}
+	}
+	var paths []string
+	dirs := make(map[string]bool)
+	for _, file := range files {
+		paths = append(paths, file)
+		if dir := filepath.Dir(file); !dirs[dir] {
+			dirs[dir] = true
+			paths = append(paths, dir)
+		}
+	}
+	return paths
+}
+
+func (w *watcher) templateModTimes() map[string]time.Time {
+	var files []string
+	for _, g := range w.config.Groups {
+		for _, pattern := range g.globs() {
+			matches, _ := filepath.Glob(pattern)
+			files = append(files, matches...)
+		}
+	}
+	return modTimes(files)
+}
+
+// modTimes returns the modification times of the paths that exist
+func modTimes(paths []string) map[string]time.Time {
+	times := make(map[string]time.Time)
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil {
+			times[path] = info.ModTime()
+		}
+	}
+	return times
+}
+
+func equalModTimes(a, b map[string]time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for path, t := range a {
+		if other, ok := b[path]; !ok || !t.Equal(other) {
+			return false
+		}
+	}
+	return true
+}
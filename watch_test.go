@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statictemplate")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	index := filepath.Join(dir, "index.tmpl")
+	output := filepath.Join(dir, "template.go")
+	assert.NoError(t, ioutil.WriteFile(index, []byte(`{{/* statictemplate: func=Index dot=string */}}hello`), 0644))
+
+	w := &watcher{config: &config{Groups: []*outputGroup{{
+		Templates: []string{filepath.Join(dir, "*.tmpl")},
+		Output:    output,
+	}}}}
+	w.update(true)
+	contents, err := ioutil.ReadFile(output)
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(contents), `"hello"`)
+	}
+
+	// Nothing changed, so the output isn't touched
+	assert.NoError(t, os.Remove(output))
+	w.poll()
+	_, err = os.Stat(output)
+	assert.True(t, os.IsNotExist(err))
+
+	assert.NoError(t, ioutil.WriteFile(index, []byte(`{{/* statictemplate: func=Index dot=string */}}bye`), 0644))
+	later := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(index, later, later))
+	w.poll()
+	contents, err = ioutil.ReadFile(output)
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(contents), `"bye"`)
+	}
+}